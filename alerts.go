@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	eventAlertFired    eventType = "alert_fired"
+	eventAlertResolved eventType = "alert_resolved"
+
+	defaultAlertInterval = 5 * time.Second
+)
+
+// Kinds of alert rule
+const (
+	alertLowBitrate  = "low_bitrate"  // Live stream's incoming bitrate below threshold (bits per second)
+	alertNotLive     = "not_live"     // Stream scheduled to have started, but isn't live
+	alertReconnects  = "reconnects"   // Stream published more than threshold times within window
+	alertNodeMissing = "node_missing" // Ingest node not sending heartbeats
+)
+
+// alertRule describes a condition to alert on. Rules come from the config
+// file, or are created through the API and stored in the database.
+type alertRule struct {
+	ID        int      `json:"id,omitempty" openapi:"readonly"`
+	Name      string   `json:"name" openapi:"required"`
+	Kind      string   `json:"kind" openapi:"required,enum=low_bitrate|not_live|reconnects|node_missing"`
+	Stream    string   `json:"stream,omitempty"` // Only apply to this stream name. Empty for all streams
+	Node      string   `json:"node,omitempty"`   // Only apply to this node name. Empty for all nodes
+	Threshold float64  `json:"threshold" openapi:"min=0"`
+	For       duration `json:"for"`    // Condition must hold for this long before firing
+	Window    duration `json:"window"` // Period reconnects are counted over
+	Source    string   `json:"source" openapi:"readonly"`
+}
+
+func (r *alertRule) validate() error {
+	if r.Name == "" {
+		return errors.New("Alert rule has no name")
+	}
+	switch r.Kind {
+	case alertLowBitrate, alertReconnects:
+		if r.Threshold <= 0 {
+			return fmt.Errorf("Alert rule %s needs a threshold", r.Name)
+		}
+	case alertNotLive, alertNodeMissing:
+	default:
+		return fmt.Errorf("Alert rule %s has unknown kind: %s", r.Name, r.Kind)
+	}
+	if r.Kind == alertReconnects && r.Window.Duration <= 0 {
+		return fmt.Errorf("Alert rule %s needs a window", r.Name)
+	}
+	return nil
+}
+
+// alertRuleRow is how API-created rules are stored in the database
+type alertRuleRow struct {
+	ID            int     `db:"id"`
+	Name          string  `db:"name"`
+	Kind          string  `db:"kind"`
+	Stream        string  `db:"stream"`
+	Node          string  `db:"node"`
+	Threshold     float64 `db:"threshold"`
+	ForSeconds    int64   `db:"for_seconds"`
+	WindowSeconds int64   `db:"window_seconds"`
+}
+
+func (row *alertRuleRow) rule() alertRule {
+	return alertRule{
+		ID:        row.ID,
+		Name:      row.Name,
+		Kind:      row.Kind,
+		Stream:    row.Stream,
+		Node:      row.Node,
+		Threshold: row.Threshold,
+		For:       duration{time.Duration(row.ForSeconds) * time.Second},
+		Window:    duration{time.Duration(row.WindowSeconds) * time.Second},
+		Source:    "api",
+	}
+}
+
+// alert is a rule whose condition holds for a particular stream or node
+type alert struct {
+	Rule       string     `json:"rule"`
+	Kind       string     `json:"kind"`
+	Target     string     `json:"target"` // Stream or node name
+	Message    string     `json:"message"`
+	Since      time.Time  `json:"since"` // When the condition started to hold
+	FiredAt    time.Time  `json:"fired_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// notifier delivers fired and resolved alerts somewhere outside the server.
+// Each is subscribed to the bus separately, so a slow webhook holds up no others.
+type notifier interface {
+	notify(t eventType, a alert) error
+}
+
+type alertNotifierConfig struct {
+	Type string // log or webhook
+	URL  string // For webhooks
+}
+
+type logNotifier struct{}
+
+func (logNotifier) notify(t eventType, a alert) error {
+	if t == eventAlertFired {
+		alertsLog.Warnf("Alert %s fired for %s: %s", a.Rule, a.Target, a.Message)
+	} else {
+		alertsLog.Infof("Alert %s resolved for %s", a.Rule, a.Target)
+	}
+	return nil
+}
+
+// webhookNotifier POSTs alerts as JSON to a URL
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n webhookNotifier) notify(t eventType, a alert) error {
+	b, err := json.Marshal(&event{t, time.Now(), a})
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook %s returned %s", n.url, resp.Status)
+	}
+	return nil
+}
+
+func newNotifiers(confs []alertNotifierConfig) ([]notifier, error) {
+	notifiers := make([]notifier, 0, len(confs))
+	for _, c := range confs {
+		switch c.Type {
+		case "log":
+			notifiers = append(notifiers, logNotifier{})
+		case "webhook":
+			if c.URL == "" {
+				return nil, errors.New("Webhook notifier has no URL")
+			}
+			notifiers = append(notifiers, webhookNotifier{c.URL, &http.Client{Timeout: 10 * time.Second}})
+		default:
+			return nil, fmt.Errorf("Unknown alert notifier type: %s", c.Type)
+		}
+	}
+	if len(notifiers) == 0 {
+		notifiers = append(notifiers, logNotifier{})
+	}
+	return notifiers, nil
+}
+
+// alertEngine periodically evaluates alert rules against the live stream
+// state, and fires and resolves alerts
+type alertEngine struct {
+	mu        sync.Mutex
+	pending   map[string]time.Time // Conditions which hold, but not yet for long enough
+	active    map[string]*alert
+	notifiers []notifier
+}
+
+func newAlertEngine(notifiers []notifier) *alertEngine {
+	return &alertEngine{
+		pending:   make(map[string]time.Time),
+		active:    make(map[string]*alert),
+		notifiers: notifiers,
+	}
+}
+
+// alertRules returns the rules from the config file followed by those
+// created through the API
+func (e *env) alertRules() ([]alertRule, error) {
+	rules := make([]alertRule, 0, len(e.conf.Alerts.Rules))
+	for _, r := range e.conf.Alerts.Rules {
+		r.Source = "config"
+		rules = append(rules, r)
+	}
+
+	rows := make([]alertRuleRow, 0)
+	err := e.db.Select(&rows, `
+		SELECT
+			id() as id, name, kind, stream, node, threshold, for_seconds, window_seconds
+		FROM
+			alert_rules
+		ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		rules = append(rules, row.rule())
+	}
+	return rules, nil
+}
+
+// condition is a target a rule's condition holds for, and since when. A zero
+// since means the condition was only just observed.
+type condition struct {
+	target  string
+	message string
+	since   time.Time
+}
+
+// evaluate returns the targets a rule's condition currently holds for
+func (e *env) evaluate(rule *alertRule, now time.Time) ([]condition, error) {
+	conds := make([]condition, 0)
+	switch rule.Kind {
+	case alertLowBitrate:
+		for _, s := range e.live.list() {
+			if rule.Stream != "" && s.Name != rule.Stream || rule.Node != "" && s.Node != rule.Node {
+				continue
+			}
+			if s.Stats != nil && float64(s.Stats.BitrateIn) < rule.Threshold {
+				conds = append(conds, condition{s.Name, fmt.Sprintf("Bitrate is %d bps", s.Stats.BitrateIn), time.Time{}})
+			}
+		}
+
+	case alertReconnects:
+		names := make(map[string]bool)
+		for _, s := range e.live.list() {
+			names[s.Name] = true
+		}
+		if rule.Stream != "" {
+			names = map[string]bool{rule.Stream: true}
+		}
+		for name := range names {
+			n := e.live.publishesSince(name, now.Add(-rule.Window.Duration))
+			// The first publish in the window isn't a reconnect
+			if float64(n-1) > rule.Threshold {
+				conds = append(conds, condition{name, fmt.Sprintf("Reconnected %d times in %s", n-1, rule.Window.Duration), time.Time{}})
+			}
+		}
+
+	case alertNotLive:
+		streams := make([]stream, 0)
+		if err := e.db.Select(&streams, streamSQL); err != nil {
+			return nil, err
+		}
+		for _, s := range streams {
+			if rule.Stream != "" && s.StreamName != rule.Stream {
+				continue
+			}
+			if !s.StartAt.Valid {
+				continue
+			}
+			exceptions, err := e.streamExceptions(s.ID)
+			if err != nil {
+				return nil, err
+			}
+			o, ok, err := s.currentOccurrence(now, 0, exceptions)
+			if err != nil {
+				alertsLog.Warnf("Unable to work out schedule of %s: %s", s.StreamName, err.Error())
+				continue
+			}
+			if !ok || now.Before(o.Start) {
+				continue
+			}
+			if _, ok := e.live.get(s.StreamName); !ok {
+				conds = append(conds, condition{s.StreamName, "Scheduled to start at " + o.Start.Format(time.RFC3339) + " but not live", o.Start})
+			}
+		}
+
+	case alertNodeMissing:
+		statuses, err := e.nodeStatuses()
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range statuses {
+			if rule.Node != "" && n.Name != rule.Node || n.Healthy {
+				continue
+			}
+			c := condition{n.Name, "No heartbeat received", time.Time{}}
+			if n.LastSeen.Valid {
+				c.message = "No heartbeat since " + n.LastSeen.Time.Format(time.RFC3339)
+				c.since = n.LastSeen.Time
+			}
+			conds = append(conds, c)
+		}
+	}
+	return conds, nil
+}
+
+// evaluateAlerts evaluates all rules once, firing alerts whose conditions have
+// held for long enough and resolving those whose conditions no longer hold
+func (e *env) evaluateAlerts() error {
+	rules, err := e.alertRules()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	holding := make(map[string]bool)
+	fired := make([]alert, 0)
+	for i := range rules {
+		rule := &rules[i]
+		conds, err := e.evaluate(rule, now)
+		if err != nil {
+			alertsLog.Errorf("Error evaluating alert rule %s: %s", rule.Name, err.Error())
+			continue
+		}
+
+		e.alerts.mu.Lock()
+		for _, c := range conds {
+			key := rule.Name + "/" + c.target
+			holding[key] = true
+			if _, ok := e.alerts.active[key]; ok {
+				continue
+			}
+			since, ok := e.alerts.pending[key]
+			if !ok {
+				since = now
+				if !c.since.IsZero() {
+					since = c.since
+				}
+				e.alerts.pending[key] = since
+			}
+			if now.Sub(since) >= rule.For.Duration {
+				a := &alert{rule.Name, rule.Kind, c.target, c.message, since, now, nil}
+				e.alerts.active[key] = a
+				delete(e.alerts.pending, key)
+				fired = append(fired, *a)
+			}
+		}
+		e.alerts.mu.Unlock()
+	}
+
+	e.alerts.mu.Lock()
+	resolved := make([]alert, 0)
+	for key := range e.alerts.pending {
+		if !holding[key] {
+			delete(e.alerts.pending, key)
+		}
+	}
+	for key, a := range e.alerts.active {
+		if !holding[key] {
+			a.ResolvedAt = &now
+			resolved = append(resolved, *a)
+			delete(e.alerts.active, key)
+		}
+	}
+	e.alerts.mu.Unlock()
+
+	for _, a := range fired {
+		e.publishEvent(eventAlertFired, a)
+	}
+	for _, a := range resolved {
+		e.publishEvent(eventAlertResolved, a)
+	}
+	e.updateDegraded()
+	return nil
+}
+
+func (e *env) runAlerts() {
+	interval := e.conf.Alerts.Interval.Duration
+	if interval <= 0 {
+		interval = defaultAlertInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := e.evaluateAlerts(); err != nil {
+			alertsLog.Errorf("Error evaluating alerts: %s", err.Error())
+		}
+	}
+}
+
+// Returns all currently firing alerts
+func getAlertsHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	e.alerts.mu.Lock()
+	alerts := make([]alert, 0, len(e.alerts.active))
+	for _, a := range e.alerts.active {
+		alerts = append(alerts, *a)
+	}
+	e.alerts.mu.Unlock()
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].FiredAt.Before(alerts[j].FiredAt) })
+
+	if err := json.NewEncoder(w).Encode(alerts); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func getAlertRulesHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	rules, err := e.alertRules()
+	if err != nil {
+		requestLog(r).Errorf("Error querying for alert rules: %s", err.Error())
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(rules); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func createAlertRuleHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	var rule alertRule
+	if err := decodeBody(w, r, &rule); err != nil {
+		return err
+	}
+	if err := rule.validate(); err != nil {
+		return statusError{
+			400,
+			err,
+		}
+	}
+	for _, c := range e.conf.Alerts.Rules {
+		if c.Name == rule.Name {
+			return statusError{
+				http.StatusConflict,
+				errors.New("An alert rule with that name is already defined in the config file"),
+			}
+		}
+	}
+
+	var n int
+	if err := e.db.Get(&n, `SELECT count(*) FROM alert_rules WHERE name = $1`, rule.Name); err != nil {
+		return err
+	}
+	if n > 0 {
+		return statusError{
+			http.StatusConflict,
+			errors.New("An alert rule with that name already exists"),
+		}
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`
+		INSERT INTO alert_rules (
+			name, kind, stream, node, threshold, for_seconds, window_seconds
+		) VALUES (
+			$1, $2, $3, $4, $5, $6, $7
+		)`,
+		rule.Name, rule.Kind, rule.Stream, rule.Node, rule.Threshold,
+		int64(rule.For.Seconds()), int64(rule.Window.Seconds()),
+	)
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if id, err := result.LastInsertId(); err == nil {
+		rule.ID = int(id)
+	}
+	rule.Source = "api"
+	e.audit(actorFromRequest(r), "create_alert_rule", rule.Name, rule.Kind)
+
+	if err := json.NewEncoder(w).Encode(&rule); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+	}
+	return nil
+}
+
+func deleteAlertRuleHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return statusError{
+			400,
+			errors.New("Non-numeric ID in URL"),
+		}
+	}
+
+	var name string
+	err = e.db.Get(&name, `SELECT name FROM alert_rules WHERE id() = $1`, int64(id))
+	if err == sql.ErrNoRows {
+		return statusError{
+			404,
+			errors.New("Alert rule not found"),
+		}
+	} else if err != nil {
+		return err
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM alert_rules WHERE id() = $1`, int64(id)); err != nil {
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	e.audit(actorFromRequest(r), "delete_alert_rule", name, "")
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// audit records an action taken by an authenticated actor. Failing to write
+// the audit log is logged, but doesn't fail the action itself.
+func (e *env) audit(actor, action, target, detail string) {
+	log.Infof("Audit: %s %s %s %s", actor, action, target, detail)
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		log.Errorf("Error writing audit log: %s", err.Error())
+		return
+	}
+	_, err = tx.Exec(`
+		INSERT INTO audit_log (
+			at, actor, action, target, detail
+		) VALUES (
+			$1, $2, $3, $4, $5
+		)`,
+		time.Now(), actor, action, target, detail,
+	)
+	if err != nil {
+		log.Errorf("Error writing audit log: %s", err.Error())
+		if err := tx.Rollback(); err != nil {
+			log.Errorf("Error rolling back failed transaction: %s", err.Error())
+		}
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Errorf("Error writing audit log: %s", err.Error())
+	}
+}
+
+// Returns the most recent audit log entries. Accepts an optional "limit" query parameter.
+func getAuditLogHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	limit := 100
+	if l, err := strconv.Atoi(r.FormValue("limit")); err == nil && l > 0 {
+		limit = l
+	}
+
+	entries := make([]auditEntry, 0)
+	err := e.db.Select(&entries, `
+		SELECT
+			id() as id, at, actor, action, target, detail
+		FROM
+			audit_log
+		ORDER BY at DESC
+		LIMIT $1`,
+		int64(limit),
+	)
+	if err != nil {
+		requestLog(r).Errorf("Error querying for audit log: %s", err.Error())
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestAuditWritten(t *testing.T) {
+	e, cleanup := newTestEnv(t)
+	defer cleanup()
+
+	// Every entry is written before audit returns
+	for i := 0; i < 50; i++ {
+		e.audit("dev", "rotate_key", "studio", "")
+	}
+	var entries []auditEntry
+	if err := e.db.Select(&entries, `SELECT id() as id, at, actor, action, target, detail FROM audit_log`); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 50 {
+		t.Fatalf("%d audit log entries written, want 50", len(entries))
+	}
+	if a := entries[0]; a.Actor != "dev" || a.Action != "rotate_key" || a.Target != "studio" || !a.At.Valid {
+		t.Errorf("Audit log entry is %+v", a)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/context"
+)
+
+type contextKey int
+
+const (
+	actorContextKey contextKey = iota
+	requestIDContextKey
+)
+
+// authToken is an API bearer token, and the name of whoever it was issued to
+type authToken struct {
+	Name  string
+	Token string
+}
+
+// authenticate checks the bearer token of a request against the configured
+// tokens, and returns the name of the matching actor. The token may also be
+// given in an "access_token" query parameter, for links opened in a browser.
+func (e *env) authenticate(r *http.Request) (string, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		return "", false
+	}
+
+	actor, found := "", false
+	for _, t := range e.conf.Auth.Tokens {
+		// Check every token, so the time taken doesn't reveal which matched
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 && !found {
+			actor, found = t.Name, true
+		}
+	}
+	return actor, found
+}
+
+// bearerToken returns the token from the Authorization header of a request,
+// or its "access_token" query parameter
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// requireAuth wraps a handler so it only runs for authenticated requests. The
+// actor's name is available to the handler through actorFromRequest.
+func requireAuth(h func(e *env, w http.ResponseWriter, r *http.Request) error) func(e *env, w http.ResponseWriter, r *http.Request) error {
+	return func(e *env, w http.ResponseWriter, r *http.Request) error {
+		actor, ok := e.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nexus-server"`)
+			return statusError{
+				http.StatusUnauthorized,
+				errors.New("Authentication required"),
+			}
+		}
+		// Use gorilla's context rather than r.WithContext, as mux keeps its
+		// URL variables there keyed by the original *http.Request
+		context.Set(r, actorContextKey, actor)
+		return h(e, w, r)
+	}
+}
+
+// actorFromRequest returns the name of the authenticated actor making a
+// request, or an empty string
+func actorFromRequest(r *http.Request) string {
+	actor, _ := context.Get(r, actorContextKey).(string)
+	return actor
+}
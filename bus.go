@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultBusBuffer = 1024
+
+var (
+	busPublished = newCounter("nexus_events_published_total",
+		"Events published to the internal event bus, by type", "type")
+	busDropped = newCounter("nexus_events_dropped_total",
+		"Events dropped because a subscriber's queue was full, by subscriber", "subscriber")
+)
+
+// bus passes events from the parts of the server where things happen to those
+// which act on them. Each subscriber has its own bounded queue and goroutine,
+// so publishing never blocks, and a slow subscriber only holds up itself.
+type bus struct {
+	mu          sync.Mutex
+	buffer      int
+	subscribers []*subscriber
+	closed      bool
+	wg          sync.WaitGroup
+}
+
+// subscriber receives events of the given types, or of every type if none
+// are given, in the order they were published
+type subscriber struct {
+	name    string
+	types   map[eventType]bool
+	queue   chan event
+	handler func(event)
+}
+
+// newBus creates a bus, whose subscribers may each have buffer events queued
+// before more are dropped
+func newBus(buffer int) *bus {
+	if buffer <= 0 {
+		buffer = defaultBusBuffer
+	}
+	return &bus{buffer: buffer}
+}
+
+// subscribe calls handler for each event of the given types, or for every
+// event if no types are given
+func (b *bus) subscribe(name string, handler func(event), types ...eventType) {
+	s := &subscriber{
+		name:    name,
+		types:   make(map[eventType]bool),
+		queue:   make(chan event, b.buffer),
+		handler: handler,
+	}
+	for _, t := range types {
+		s.types[t] = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, s)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for ev := range s.queue {
+			s.handler(ev)
+		}
+	}()
+}
+
+// publish queues an event for every subscriber to it. Subscribers whose queue
+// is full miss the event.
+func (b *bus) publish(t eventType, data interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	// Events are queued while holding the lock, so every subscriber sees them
+	// in the same order
+	ev := event{t, time.Now(), data}
+	busPublished.inc(string(t))
+	for _, s := range b.subscribers {
+		if len(s.types) > 0 && !s.types[t] {
+			continue
+		}
+		select {
+		case s.queue <- ev:
+		default:
+			busDropped.inc(s.name)
+			busLog.Warnf("Subscriber %s is too slow, dropped %s event", s.name, t)
+		}
+	}
+}
+
+// close stops the bus, and waits up to timeout for subscribers to handle the
+// events already queued. Returns false if they didn't finish in time.
+func (b *bus) close(timeout time.Duration) bool {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		for _, s := range b.subscribers {
+			close(s.queue)
+		}
+	}
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	testEventA eventType = "test_a"
+	testEventB eventType = "test_b"
+)
+
+// dropped returns how many events a subscriber has missed
+func dropped(subscriber string) int {
+	busDropped.mu.Lock()
+	defer busDropped.mu.Unlock()
+	return int(busDropped.values[subscriber])
+}
+
+func TestBusOrder(t *testing.T) {
+	b := newBus(1000)
+	var all, onlyA []int
+	b.subscribe("order_all", func(ev event) { all = append(all, ev.Data.(int)) })
+	b.subscribe("order_a", func(ev event) { onlyA = append(onlyA, ev.Data.(int)) }, testEventA)
+
+	for i := 0; i < 500; i++ {
+		typ := testEventA
+		if i%3 == 0 {
+			typ = testEventB
+		}
+		b.publish(typ, i)
+	}
+	// Once closed, the handlers have finished with their slices
+	if !b.close(time.Second) {
+		t.Fatal("Subscribers didn't finish in time")
+	}
+
+	if len(all) != 500 {
+		t.Fatalf("Subscriber to every type got %d events, want 500", len(all))
+	}
+	for i, n := range all {
+		if n != i {
+			t.Fatalf("Subscriber to every type got event %d at position %d", n, i)
+		}
+	}
+	if len(onlyA) != 333 {
+		t.Fatalf("Subscriber to %s got %d events, want 333", testEventA, len(onlyA))
+	}
+	for i, n := range onlyA {
+		if n%3 == 0 {
+			t.Fatalf("Subscriber to %s got event %d, of type %s", testEventA, n, testEventB)
+		}
+		if i > 0 && n <= onlyA[i-1] {
+			t.Fatalf("Subscriber to %s got event %d after %d", testEventA, n, onlyA[i-1])
+		}
+	}
+}
+
+func TestBusSlowSubscriber(t *testing.T) {
+	const buffer, events = 4, 100
+	b := newBus(buffer)
+
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	var slow []int
+	b.subscribe("slow", func(ev event) {
+		if len(slow) == 0 {
+			close(blocked)
+			<-release
+		}
+		slow = append(slow, ev.Data.(int))
+	})
+
+	fast := make(chan int)
+	b.subscribe("fast", func(ev event) { fast <- ev.Data.(int) })
+
+	slowDropped, fastDropped := dropped("slow"), dropped("fast")
+
+	// The slow subscriber takes the first event, then blocks until released.
+	// Its queue then fills, and everything after is dropped. The fast one
+	// keeps up, so gets each event before the next is published.
+	for i := 0; i < events; i++ {
+		start := time.Now()
+		b.publish(testEventA, i)
+		if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+			t.Errorf("Publishing took %s while a subscriber was blocked", elapsed)
+		}
+		if i == 0 {
+			<-blocked
+		}
+		select {
+		case n := <-fast:
+			if n != i {
+				t.Fatalf("Fast subscriber got event %d, want %d", n, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Fast subscriber didn't get event %d while the slow one was blocked", i)
+		}
+	}
+	if n := dropped("fast") - fastDropped; n != 0 {
+		t.Errorf("Fast subscriber dropped %d events", n)
+	}
+	if n := dropped("slow") - slowDropped; n != events-buffer-1 {
+		t.Errorf("Slow subscriber dropped %d events, want %d", n, events-buffer-1)
+	}
+
+	close(release)
+	if !b.close(time.Second) {
+		t.Fatal("Subscribers didn't finish in time")
+	}
+	if len(slow) != buffer+1 {
+		t.Fatalf("Slow subscriber got %d events, want %d", len(slow), buffer+1)
+	}
+	for i, n := range slow {
+		if n != i {
+			t.Errorf("Slow subscriber got event %d at position %d", n, i)
+		}
+	}
+}
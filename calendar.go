@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	icalTimeFormat      = "20060102T150405Z"
+	icalLocalTimeFormat = "20060102T150405"
+)
+
+// icalEscape escapes a TEXT property value, as per RFC 5545 section 3.3.11
+func icalEscape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+// icalWriter writes content lines, folding them at 75 octets and ending them
+// with CRLF as RFC 5545 requires
+type icalWriter struct {
+	bytes.Buffer
+	zones map[string]time.Time // Time zones used by timeLine, and the earliest time written in each
+}
+
+func (w *icalWriter) line(name, value string) {
+	l := name + ":" + value
+	limit := 75
+	for len(l) > limit {
+		// Don't split a multi-byte UTF-8 sequence across lines
+		cut := limit
+		for cut > 0 && l[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		w.WriteString(l[:cut] + "\r\n ")
+		l = l[cut:]
+		limit = 74 // Continuation lines start with a space
+	}
+	w.WriteString(l + "\r\n")
+}
+
+// timeLine writes a DATE-TIME property. Times of streams with a time zone are
+// written as local time with a TZID, so calendar apps follow DST changes in
+// recurring events. The time zone must then be written with timezone.
+func (w *icalWriter) timeLine(name string, t time.Time, s *stream) {
+	loc, err := s.location()
+	if s.Timezone == "" || err != nil {
+		w.line(name, t.UTC().Format(icalTimeFormat))
+		return
+	}
+	w.line(name+";TZID="+s.Timezone, t.In(loc).Format(icalLocalTimeFormat))
+
+	if w.zones == nil {
+		w.zones = make(map[string]time.Time)
+	}
+	if first, ok := w.zones[s.Timezone]; !ok || t.Before(first) {
+		w.zones[s.Timezone] = t
+	}
+}
+
+// Years after the current one which VTIMEZONEs list offset changes for. Those
+// in the last year repeat yearly after that.
+const icalTimezoneYears = 5
+
+// zoneTransition is a change in the UTC offset of a time zone
+type zoneTransition struct {
+	at       time.Time // First instant at the new offset
+	name     string    // Abbreviation of the zone after the change, e.g. BST
+	from, to int       // Offsets in seconds east of UTC
+}
+
+// zoneTransitions returns the UTC offset changes of loc between from and to.
+// Changes are found by stepping a day at a time, then bisecting to the second.
+func zoneTransitions(loc *time.Location, from, to time.Time) []zoneTransition {
+	transitions := make([]zoneTransition, 0)
+	t := from.In(loc)
+	_, offset := t.Zone()
+	for t.Before(to) {
+		next := t.Add(24 * time.Hour)
+		if _, o := next.Zone(); o == offset {
+			t = next
+			continue
+		}
+		for next.Sub(t) > time.Second {
+			mid := t.Add(next.Sub(t) / 2)
+			if _, o := mid.Zone(); o == offset {
+				t = mid
+			} else {
+				next = mid
+			}
+		}
+		next = next.Truncate(time.Second)
+		name, o := next.Zone()
+		transitions = append(transitions, zoneTransition{next, name, offset, o})
+		t, offset = next, o
+	}
+	return transitions
+}
+
+func icalOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign, offset = "-", -offset
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset/60%60)
+}
+
+// timezone writes a VTIMEZONE for a time zone used by timeLine, covering the
+// year before first up to icalTimezoneYears from now
+func (w *icalWriter) timezone(tzid string, first time.Time) {
+	loc, err := time.LoadLocation(tzid)
+	if err != nil {
+		return
+	}
+	from := time.Date(first.In(loc).Year()-1, time.January, 1, 0, 0, 0, 0, loc)
+	lastYear := time.Now().In(loc).Year() + icalTimezoneYears
+	to := time.Date(lastYear+1, time.January, 1, 0, 0, 0, 0, loc)
+
+	w.line("BEGIN", "VTIMEZONE")
+	w.line("TZID", tzid)
+	transitions := zoneTransitions(loc, from, to)
+	if len(transitions) == 0 {
+		name, offset := from.Zone()
+		transitions = append(transitions, zoneTransition{from, name, offset, offset})
+	}
+	for _, t := range transitions {
+		component := "STANDARD"
+		if t.to > t.from {
+			component = "DAYLIGHT"
+		}
+		// The onset is given as the local time before the change
+		onset := t.at.In(time.FixedZone("", t.from))
+		w.line("BEGIN", component)
+		w.line("DTSTART", onset.Format(icalLocalTimeFormat))
+		w.line("TZOFFSETFROM", icalOffset(t.from))
+		w.line("TZOFFSETTO", icalOffset(t.to))
+		if t.name != "" {
+			w.line("TZNAME", icalEscape(t.name))
+		}
+		if onset.Year() == lastYear && t.from != t.to {
+			// Assume the change keeps happening on the same weekday of the month
+			y, m, d := onset.Date()
+			n := strconv.Itoa((d-1)/7 + 1)
+			if d > daysIn(y, m)-7 {
+				n = "-1"
+			}
+			day := strings.ToUpper(onset.Weekday().String()[:2])
+			w.line("RRULE", fmt.Sprintf("FREQ=YEARLY;BYMONTH=%d;BYDAY=%s%s", m, n, day))
+		}
+		w.line("END", component)
+	}
+	w.line("END", "VTIMEZONE")
+}
+
+// icalRRule returns a stream's recurrence rule for a VEVENT. RFC 5545 requires
+// UNTIL to be in UTC when DTSTART has a time zone, so it's converted from the
+// stream's time zone.
+func icalRRule(s *stream) string {
+	loc, err := s.location()
+	if err != nil {
+		loc = time.UTC
+	}
+	parts := strings.Split(strings.TrimPrefix(s.RRule, "RRULE:"), ";")
+	for i, part := range parts {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || strings.ToUpper(kv[0]) != "UNTIL" {
+			continue
+		}
+		if until, err := parseRRuleTime(strings.ToUpper(kv[1]), loc); err == nil {
+			parts[i] = "UNTIL=" + until.UTC().Format(icalTimeFormat)
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// calendarAuthorized returns true if a request may see private streams in the
+// calendar feed. Calendar apps can't set headers, so the token is given in the
+// URL.
+func (e *env) calendarAuthorized(r *http.Request) bool {
+	token := r.FormValue("token")
+	if token != "" && e.conf.Calendar.Token != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(e.conf.Calendar.Token)) == 1 {
+		return true
+	}
+	_, ok := e.authenticate(r)
+	return ok
+}
+
+// calendarDomain is used to make event UIDs globally unique
+func (e *env) calendarDomain() string {
+	if e.conf.Calendar.Domain != "" {
+		return e.conf.Calendar.Domain
+	}
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return "nexus-server"
+}
+
+// Serves scheduled streams as an iCalendar feed. Only public streams are included, unless a valid
+// token is given. Accepts "public" to restrict a private feed to public streams, and "stream" (may
+// be repeated) to only include the streams with those ids.
+func calendarHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	streams := make([]stream, 0)
+	if err := e.db.Select(&streams, streamSQL+`ORDER BY start_at`); err != nil {
+		requestLog(r).Errorf("Error querying for streams: %s", err.Error())
+		return err
+	}
+
+	private := e.calendarAuthorized(r)
+	if public, err := strconv.ParseBool(r.FormValue("public")); err == nil && public {
+		private = false
+	}
+	ids := make(map[int]bool)
+	for _, id := range r.Form["stream"] {
+		if i, err := strconv.Atoi(id); err == nil {
+			ids[i] = true
+		}
+	}
+
+	now := time.Now().UTC().Format(icalTimeFormat)
+	domain := e.calendarDomain()
+
+	// Events are written first, to find the time zones they use
+	var events icalWriter
+	for _, s := range streams {
+		if !s.StartAt.Valid || !s.IsPublic && !private || len(ids) > 0 && !ids[s.ID] {
+			continue
+		}
+		uid := "stream-" + strconv.Itoa(s.ID) + "@" + domain
+		events.line("BEGIN", "VEVENT")
+		events.line("UID", uid)
+		events.line("DTSTAMP", now)
+		events.timeLine("DTSTART", s.StartAt.Time, &s)
+		if s.EndAt.Valid {
+			events.timeLine("DTEND", s.EndAt.Time, &s)
+		}
+		events.line("SUMMARY", icalEscape(s.DisplayName))
+		if !s.IsPublic {
+			events.line("CLASS", "PRIVATE")
+		}
+		if s.RRule == "" {
+			events.line("END", "VEVENT")
+			continue
+		}
+
+		events.line("RRULE", icalRRule(&s))
+		exceptions, err := e.streamExceptions(s.ID)
+		if err != nil {
+			requestLog(r).Errorf("Error querying for stream exceptions: %s", err.Error())
+			return err
+		}
+		for _, ex := range exceptions {
+			if ex.Cancelled {
+				events.timeLine("EXDATE", ex.Occurrence, &s)
+			}
+		}
+		events.line("END", "VEVENT")
+
+		// Moved occurrences override the recurring event
+		for _, ex := range exceptions {
+			if ex.Cancelled || !ex.StartAt.Valid {
+				continue
+			}
+			o := occurrence{Start: ex.Occurrence}
+			if s.EndAt.Valid {
+				end := ex.Occurrence.Add(s.EndAt.Time.Sub(s.StartAt.Time))
+				o.End = &end
+			}
+			ex.apply(&o, s.EndAt.Time.Sub(s.StartAt.Time))
+
+			events.line("BEGIN", "VEVENT")
+			events.line("UID", uid)
+			events.line("DTSTAMP", now)
+			events.timeLine("RECURRENCE-ID", ex.Occurrence, &s)
+			events.timeLine("DTSTART", o.Start, &s)
+			if o.End != nil {
+				events.timeLine("DTEND", *o.End, &s)
+			}
+			events.line("SUMMARY", icalEscape(s.DisplayName))
+			if !s.IsPublic {
+				events.line("CLASS", "PRIVATE")
+			}
+			events.line("END", "VEVENT")
+		}
+	}
+
+	var cal icalWriter
+	cal.line("BEGIN", "VCALENDAR")
+	cal.line("VERSION", "2.0")
+	cal.line("PRODID", "-//YSTV//Nexus Server "+VERSION+"//EN")
+	cal.line("CALSCALE", "GREGORIAN")
+	cal.line("METHOD", "PUBLISH")
+	if e.conf.Calendar.Name != "" {
+		cal.line("X-WR-CALNAME", icalEscape(e.conf.Calendar.Name))
+	}
+	tzids := make([]string, 0, len(events.zones))
+	for tzid := range events.zones {
+		tzids = append(tzids, tzid)
+	}
+	sort.Strings(tzids)
+	for _, tzid := range tzids {
+		cal.timezone(tzid, events.zones[tzid])
+	}
+	cal.Write(events.Bytes())
+	cal.line("END", "VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="nexus.ics"`)
+	if _, err := cal.WriteTo(w); err != nil {
+		requestLog(r).Warnf("Error writing calendar: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const channelSQL = `
+	SELECT
+		id() as id, name, display_name, description, playback_name, created_at
+	FROM
+		channels
+`
+
+// Channel names and playback names end up in URLs and RTMP stream names
+var channelNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// programme is an occurrence of one of a channel's streams
+type programme struct {
+	Stream     stream      `json:"stream"`
+	Occurrence *occurrence `json:"occurrence"` // Nil if the stream is live outside its schedule
+	Live       bool        `json:"live"`
+}
+
+// channelByID fetches a single channel, given the id from a request URL
+func (e *env) channelByID(id string) (channel, error) {
+	var c channel
+	intID, err := strconv.Atoi(id)
+	if err != nil {
+		return c, statusError{
+			400,
+			errors.New("Non-numeric ID in URL"),
+		}
+	}
+	err = e.db.Get(&c, channelSQL+`WHERE id() = $1`, int64(intID))
+	if err == sql.ErrNoRows {
+		return c, statusError{
+			404,
+			errors.New("Channel not found"),
+		}
+	} else if err != nil {
+		log.Errorf("Error querying for channel: %s", err.Error())
+		return c, err
+	}
+	return c, nil
+}
+
+// validateChannel checks a channel's names, and that they don't clash with
+// another channel or with a stream name, which would make on_play ambiguous
+func (e *env) validateChannel(c *channel) error {
+	if !channelNamePattern.MatchString(c.Name) || !channelNamePattern.MatchString(c.PlaybackName) {
+		return statusError{
+			400,
+			errors.New("Channel name and playback_name are required, and may only contain a-z, 0-9, _ and -"),
+		}
+	}
+
+	var n int
+	err := e.db.Get(&n, `
+		SELECT count(*) FROM channels
+		WHERE (name = $1 OR playback_name = $2) AND id() != $3`,
+		c.Name, c.PlaybackName, int64(c.ID),
+	)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		err = e.db.Get(&n, `SELECT count(*) FROM streams WHERE stream_name = $1`, c.PlaybackName)
+		if err != nil {
+			return err
+		}
+	}
+	if n > 0 {
+		return statusError{
+			409,
+			errors.New("Channel name or playback_name already in use"),
+		}
+	}
+	return nil
+}
+
+// checkStreamChannel checks the channel a stream belongs to exists, and that
+// its name isn't used by another stream or as a channel's playback name
+func (e *env) checkStreamChannel(s *stream) error {
+	var n int
+	err := e.db.Get(&n, `SELECT count(*) FROM streams WHERE stream_name = $1 AND id() != $2`, s.StreamName, int64(s.ID))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return duplicateError{"stream_name", "is already in use by another stream"}
+	}
+	if err := e.db.Get(&n, `SELECT count(*) FROM channels WHERE playback_name = $1`, s.StreamName); err != nil {
+		return err
+	}
+	if n > 0 {
+		return duplicateError{"stream_name", "is in use as a channel's playback_name"}
+	}
+	if s.ChannelID == 0 {
+		return nil
+	}
+	if err := e.db.Get(&n, `SELECT count(*) FROM channels WHERE id() = $1`, int64(s.ChannelID)); err != nil {
+		return err
+	}
+	if n == 0 {
+		return statusError{
+			400,
+			errors.New("Channel does not exist"),
+		}
+	}
+	return nil
+}
+
+// channelProgrammes returns what is on a channel at t, and what is on next.
+// A live stream takes precedence over the schedule for what is on now. Only
+// public streams are considered if publicOnly is set.
+func (e *env) channelProgrammes(c channel, t time.Time, publicOnly bool) (*programme, *programme, error) {
+	query := streamSQL + `WHERE channel_id = $1`
+	if publicOnly {
+		query += ` AND is_public`
+	}
+	streams := make([]stream, 0)
+	if err := e.db.Select(&streams, query, int64(c.ID)); err != nil {
+		return nil, nil, err
+	}
+
+	var now, next *programme
+	var nowSince time.Time
+	for _, s := range streams {
+		exceptions, err := e.streamExceptions(s.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Look ahead far enough to find the next occurrence of even a yearly stream
+		occs, err := s.occurrences(t, t.AddDate(1, 0, 1), exceptions)
+		if err != nil {
+			log.Warnf("Unable to expand schedule of stream %d: %s", s.ID, err.Error())
+			continue
+		}
+
+		var running *occurrence
+		for i := range occs {
+			o := &occs[i]
+			if o.Cancelled {
+				continue
+			}
+			if o.Start.After(t) {
+				if next == nil || o.Start.Before(next.Occurrence.Start) {
+					next = &programme{s, o, false}
+				}
+			} else if running == nil {
+				running = o
+			}
+		}
+
+		ls, live := e.live.get(s.StreamName)
+		switch {
+		case live && (now == nil || !now.Live || ls.Since.After(nowSince)):
+			now, nowSince = &programme{s, running, true}, ls.Since
+		case running != nil && now == nil:
+			now = &programme{s, running, false}
+		case running != nil && !now.Live && running.Start.After(now.Occurrence.Start):
+			now = &programme{s, running, false}
+		}
+	}
+	return now, next, nil
+}
+
+func getChannelsHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	channels := make([]channel, 0)
+	if err := e.db.Select(&channels, channelSQL+`ORDER BY name`); err != nil {
+		requestLog(r).Errorf("Error querying for channels: %s", err.Error())
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(channels); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func getChannelHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	c, err := e.channelByID(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(&c); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func createChannelHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	var c channel
+	if err := decodeBody(w, r, &c); err != nil {
+		return err
+	}
+	c.ID = -1 // Not yet stored, so can't clash with itself
+	if err := e.validateChannel(&c); err != nil {
+		return err
+	}
+	c.CreatedAt = toNullTime(time.Now())
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`
+		INSERT INTO channels (
+			name, display_name, description, playback_name, created_at
+		) VALUES (
+			$1, $2, $3, $4, $5
+		)`,
+		c.Name, c.DisplayName, c.Description, c.PlaybackName, c.CreatedAt,
+	)
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		requestLog(r).Errorf("Error retrieving ID of inserted row: %s", err.Error())
+	}
+	c.ID = int(id)
+
+	if err := json.NewEncoder(w).Encode(&c); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+	}
+	return nil
+}
+
+func updateChannelHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	existing, err := e.channelByID(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+
+	var c channel
+	if err := decodeBody(w, r, &c); err != nil {
+		return err
+	}
+	c.ID, c.CreatedAt = existing.ID, existing.CreatedAt
+	if err := e.validateChannel(&c); err != nil {
+		return err
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE channels
+		SET name = $2, display_name = $3, description = $4, playback_name = $5
+		WHERE id() = $1`,
+		int64(c.ID), c.Name, c.DisplayName, c.Description, c.PlaybackName,
+	)
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(&c); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+	}
+	return nil
+}
+
+// Deletes a channel. Its streams are kept, but no longer belong to a channel.
+func deleteChannelHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	c, err := e.channelByID(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE streams SET channel_id = 0 WHERE channel_id = $1`, int64(c.ID))
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM channels WHERE id() = $1`, int64(c.ID))
+	}
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+func getChannelStreamsHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	c, err := e.channelByID(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	streams := make([]stream, 0)
+	if err := e.db.Select(&streams, streamSQL+`WHERE channel_id = $1`, int64(c.ID)); err != nil {
+		requestLog(r).Errorf("Error querying for stream(s): %s", err.Error())
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(filterStreams(r, streams)); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// Returns what is on a channel now, or null if nothing is
+func getChannelNowHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	c, err := e.channelByID(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	now, _, err := e.channelProgrammes(c, time.Now(), false)
+	if err != nil {
+		requestLog(r).Errorf("Error finding channel programmes: %s", err.Error())
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(now); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// Returns the next scheduled occurrence on a channel, or null if there is none
+func getChannelNextHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	c, err := e.channelByID(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	_, next, err := e.channelProgrammes(c, time.Now(), false)
+	if err != nil {
+		requestLog(r).Errorf("Error finding channel programmes: %s", err.Error())
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(next); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// Handle requests originating from nginx-rtmp's on_play feature. Playing a channel's playback name
+// is redirected to whichever of its streams is live; other names are allowed through unchanged.
+// Each node should identify itself with a "node" query parameter, so viewers can be sent to the
+// node the stream is live on.
+func rpcPlayHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	name := r.FormValue("name")
+	if name == "" {
+		return statusError{
+			400,
+			errors.New("No stream name given"),
+		}
+	}
+
+	var c channel
+	err := e.db.Get(&c, channelSQL+`WHERE playback_name = $1`, name)
+	if err == sql.ErrNoRows {
+		return nil // Not a channel, so play the stream itself
+	} else if err != nil {
+		return err
+	}
+
+	now, _, err := e.channelProgrammes(c, time.Now(), false)
+	if err != nil {
+		return err
+	}
+	if now == nil || !now.Live {
+		return statusError{
+			404,
+			errors.New("Nothing is live on channel " + c.Name),
+		}
+	}
+
+	// A Location without a scheme renames the stream locally; an rtmp:// URL
+	// makes nginx-rtmp pull it from another node
+	location := now.Stream.StreamName
+	ls, _ := e.live.get(location)
+	if nodeName := r.FormValue("node"); nodeName != "" && ls.Node != "" && ls.Node != nodeName {
+		var n node
+		err := e.db.Get(&n, `SELECT name, rtmp_url FROM nodes WHERE name = $1`, ls.Node)
+		if err == nil {
+			location = ingestURL(n, location)
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+	}
+	requestLog(r).Debugf("Playing %s on channel %s", location, c.Name)
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusFound)
+	return nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -23,15 +25,133 @@ const (
 
 // Client is a websocket client
 type Client struct {
-	hub  *Hub
-	conn *websocket.Conn
-	send chan []byte
+	hub       *Hub
+	conn      *websocket.Conn
+	queue     *sendQueue
+	node      string
+	requestID string
+	connected time.Time
+	log       *log.Entry
+
+	// Counted by the hub's goroutine
+	dropped, coalesced int
+}
+
+// queued is a message waiting to be written to a client. Messages with the
+// same key describe the same thing, so only the latest need be sent.
+type queued struct {
+	key  string
+	data []byte
+}
+
+// sendQueue holds the messages waiting to be written to a client, up to a
+// limit, after which the hub's backpressure policy applies
+type sendQueue struct {
+	mu          sync.Mutex
+	items       []queued
+	limit       int
+	missed      int // Messages dropped or coalesced since the client was last told
+	closed      bool
+	closeCode   int
+	closeReason string
+	ready       chan struct{} // Signalled when messages are added, or the queue is closed
+}
+
+func newSendQueue(limit int) *sendQueue {
+	return &sendQueue{limit: limit, ready: make(chan struct{}, 1)}
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Outcomes of pushing a message to a queue
+const (
+	pushQueued    = iota
+	pushDropped   // The oldest message was dropped to make room
+	pushCoalesced // An older message with the same key was replaced
+	pushFull      // Nothing was queued. The client should be disconnected
+)
+
+// push queues a message, applying policy if the queue is full
+func (q *sendQueue) push(m queued, policy string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return pushQueued
+	}
+	defer q.signal()
+
+	if len(q.items) < q.limit {
+		q.items = append(q.items, m)
+		return pushQueued
+	}
+	switch policy {
+	case hubPolicyCoalesce:
+		if m.key != "" {
+			for i, old := range q.items {
+				if old.key == m.key {
+					// Move to the back, keeping messages in the order they were sent
+					q.items = append(append(q.items[:i:i], q.items[i+1:]...), m)
+					q.missed++
+					return pushCoalesced
+				}
+			}
+		}
+		fallthrough
+	case hubPolicyDropOldest:
+		q.items = append(q.items[1:], m)
+		q.missed++
+		return pushDropped
+	default:
+		return pushFull
+	}
+}
+
+// close stops the queue, so the client is sent a close frame with the given
+// code and reason rather than anything still queued
+func (q *sendQueue) close(code int, reason string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed, q.closeCode, q.closeReason = true, code, reason
+	q.items = nil
+	q.signal()
+}
+
+// pop removes the oldest queued message, returning it with the number of
+// messages missed before it. If the queue has been closed, the close frame to
+// send is returned instead.
+func (q *sendQueue) pop() (m queued, missed int, closeMsg []byte, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return m, 0, websocket.FormatCloseMessage(q.closeCode, q.closeReason), true
+	}
+	if len(q.items) == 0 {
+		return m, 0, nil, false
+	}
+	m, missed = q.items[0], q.missed
+	q.items, q.missed = q.items[1:], 0
+	return m, missed, nil, true
+}
+
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
 }
 
 func (c *Client) readPump() {
 	defer func() {
 		c.hub.unregister <- c
 		c.conn.Close()
+		c.log.Debugf("Websocket from %s closed", c.conn.RemoteAddr())
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -41,15 +161,38 @@ func (c *Client) readPump() {
 		_, msg, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
-				log.Warnf("Websocket closed unexpectedly: %v", err)
+				c.log.Warnf("Websocket closed unexpectedly: %v", err)
 			}
 			break
 		}
-		c.hub.incoming <- &Message{msg, c.conn.RemoteAddr()}
+		c.hub.incoming <- &Message{msg, c.conn.RemoteAddr(), c.node, c.log, c}
 	}
 
 }
 
+// write writes a message in its own frame, returning false if the connection
+// has failed
+func (c *Client) write(data []byte) bool {
+	if data == nil {
+		return true
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(websocket.TextMessage, data) == nil
+}
+
+// missedMarker returns the event telling a client how many messages it missed
+func (c *Client) missedMarker(missed int) []byte {
+	b, err := json.Marshal(&event{eventMissedEvents, time.Now(), missedEventsEvent{missed}})
+	if err != nil {
+		c.log.Errorf("Error encoding %s event: %s", eventMissedEvents, err.Error())
+		return nil
+	}
+	return b
+}
+
+// writePump writes queued messages to the client, each in its own frame. If
+// any were missed, a marker saying how many comes first, so the client knows
+// to resync.
 func (c *Client) writePump() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
@@ -58,32 +201,30 @@ func (c *Client) writePump() {
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// Hub Closed channel
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Add queued messages too
-			for i := 0; i < len(c.send); i++ {
-				w.Write(<-c.send)
-			}
-
-			if err := w.Close(); err != nil {
-				return
+		case <-c.queue.ready:
+			// Messages are taken one at a time, so those waiting behind a slow
+			// write stay subject to the hub's policy
+			for {
+				m, missed, closeMsg, ok := c.queue.pop()
+				if !ok {
+					break
+				}
+				if closeMsg != nil {
+					// Hub closed the queue
+					c.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(writeWait))
+					return
+				}
+				if missed > 0 && !c.write(c.missedMarker(missed)) {
+					return
+				}
+				if !c.write(m.data) {
+					return
+				}
 			}
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
-				log.Error(err)
+				c.log.Error(err)
 				return
 			}
 		}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultConflictHorizon = 90 * 24 * time.Hour
+
+// bookedOccurrence is an occurrence of a stream which holds a resource
+type bookedOccurrence struct {
+	StreamID    int        `json:"stream_id"`
+	DisplayName string     `json:"display_name"`
+	Start       time.Time  `json:"start_at"`
+	End         *time.Time `json:"end_at"`
+}
+
+// overlaps returns true if two occurrences run at the same time. Occurrences
+// without an end run indefinitely.
+func (b *bookedOccurrence) overlaps(o *bookedOccurrence) bool {
+	return (b.End == nil || o.Start.Before(*b.End)) && (o.End == nil || b.Start.Before(*o.End))
+}
+
+// scheduleConflict is a pair of occurrences which need the same exclusive
+// resource at the same time
+type scheduleConflict struct {
+	Resource string             `json:"resource"`
+	Streams  []bookedOccurrence `json:"streams"`
+}
+
+// resourceKind returns the kind of a kind:name resource
+func resourceKind(resource string) string {
+	return strings.SplitN(resource, ":", 2)[0]
+}
+
+// validateResources checks the resources a stream books are of the form
+// kind:name
+func (s *stream) validateResources() error {
+	if s.Resources == nil {
+		s.Resources = stringList{}
+	}
+	for _, res := range s.Resources {
+		parts := strings.SplitN(res, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return errors.New("Resources must be of the form kind:name")
+		}
+		if strings.Contains(res, ",") {
+			return errors.New("Resources may not contain commas")
+		}
+	}
+	return nil
+}
+
+// exclusiveResources returns the resources of a stream which only one stream
+// may use at a time. The ingest node a stream has been assigned counts as the
+// resource node:<name>.
+func (e *env) exclusiveResources(s *stream, assignments map[int]string) []string {
+	exclusive := make(map[string]bool)
+	for _, kind := range e.conf.Schedule.Exclusive {
+		exclusive[kind] = true
+	}
+	resources := []string(s.Resources)
+	if node, ok := assignments[s.ID]; ok {
+		resources = append(resources, "node:"+node)
+	}
+
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(resources))
+	for _, res := range resources {
+		if exclusive[resourceKind(res)] && !seen[res] {
+			seen[res] = true
+			result = append(result, res)
+		}
+	}
+	return result
+}
+
+// scheduleConflicts finds occurrences between from and to which need the same
+// exclusive resource at the same time. If candidate is given, it replaces the
+// stored stream with the same ID (or is added, if new) and only conflicts
+// involving it are returned. Likewise, exception replaces any stored exception
+// for the same occurrence.
+func (e *env) scheduleConflicts(from, to time.Time, candidate *stream, exception *streamException) ([]scheduleConflict, error) {
+	conflicts := make([]scheduleConflict, 0)
+	if len(e.conf.Schedule.Exclusive) == 0 {
+		return conflicts, nil
+	}
+
+	streams := make([]stream, 0)
+	if err := e.db.Select(&streams, streamSQL); err != nil {
+		return nil, err
+	}
+	if candidate != nil {
+		replaced := false
+		for i := range streams {
+			if streams[i].ID == candidate.ID {
+				streams[i], replaced = *candidate, true
+			}
+		}
+		if !replaced {
+			streams = append(streams, *candidate)
+		}
+	}
+
+	var rows []struct {
+		StreamID int    `db:"stream_id"`
+		Node     string `db:"node"`
+	}
+	if err := e.db.Select(&rows, `SELECT stream_id, node FROM ingest_assignments`); err != nil {
+		return nil, err
+	}
+	assignments := make(map[int]string)
+	for _, row := range rows {
+		assignments[row.StreamID] = row.Node
+	}
+
+	exceptions := make([]streamException, 0)
+	if err := e.db.Select(&exceptions, `
+		SELECT
+			id() as id, stream_id, occurrence, cancelled, start_at, end_at
+		FROM
+			stream_exceptions`,
+	); err != nil {
+		return nil, err
+	}
+	if exception != nil {
+		replaced := false
+		for i := range exceptions {
+			if exceptions[i].StreamID == exception.StreamID && exceptions[i].Occurrence.Equal(exception.Occurrence) {
+				exceptions[i], replaced = *exception, true
+			}
+		}
+		if !replaced {
+			exceptions = append(exceptions, *exception)
+		}
+	}
+	byStream := make(map[int][]streamException)
+	for _, ex := range exceptions {
+		byStream[ex.StreamID] = append(byStream[ex.StreamID], ex)
+	}
+
+	booked := make(map[string][]bookedOccurrence)
+	for i := range streams {
+		s := &streams[i]
+		resources := e.exclusiveResources(s, assignments)
+		if len(resources) == 0 {
+			continue
+		}
+		occs, err := s.occurrences(from, to, byStream[s.ID])
+		if err != nil {
+			log.Warnf("Unable to expand schedule of stream %d: %s", s.ID, err.Error())
+			continue
+		}
+		for _, o := range occs {
+			if o.Cancelled {
+				continue
+			}
+			b := bookedOccurrence{s.ID, s.DisplayName, o.Start, o.End}
+			for _, res := range resources {
+				booked[res] = append(booked[res], b)
+			}
+		}
+	}
+
+	resources := make([]string, 0, len(booked))
+	for res := range booked {
+		resources = append(resources, res)
+	}
+	sort.Strings(resources)
+	for _, res := range resources {
+		occs := booked[res]
+		sort.Slice(occs, func(i, j int) bool { return occs[i].Start.Before(occs[j].Start) })
+		for i := range occs {
+			for j := i + 1; j < len(occs); j++ {
+				a, b := occs[i], occs[j]
+				if a.End != nil && !b.Start.Before(*a.End) {
+					break // Sorted by start, so nothing later overlaps a either
+				}
+				if a.StreamID == b.StreamID || !a.overlaps(&b) {
+					continue
+				}
+				if candidate != nil && a.StreamID != candidate.ID && b.StreamID != candidate.ID {
+					continue
+				}
+				if candidate != nil && b.StreamID == candidate.ID {
+					a, b = b, a // List the candidate first
+				}
+				conflicts = append(conflicts, scheduleConflict{res, []bookedOccurrence{a, b}})
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// conflictHorizon returns the period to check schedules for conflicts over
+func (e *env) conflictHorizon() time.Duration {
+	if e.conf.Schedule.Horizon.Duration <= 0 {
+		return defaultConflictHorizon
+	}
+	return e.conf.Schedule.Horizon.Duration
+}
+
+// conflictError is returned when a change would leave streams needing the
+// same exclusive resource at the same time
+type conflictError struct {
+	conflicts []scheduleConflict
+}
+
+func (c conflictError) Error() string {
+	return "Schedule conflicts with other streams"
+}
+
+func (c conflictError) Status() int {
+	return http.StatusConflict
+}
+
+// checkConflicts rejects creating or updating a stream which would need an
+// exclusive resource at the same time as another stream, with a conflictError
+// listing the conflicts
+func (e *env) checkConflicts(s stream) error {
+	now := time.Now()
+	conflicts, err := e.scheduleConflicts(now, now.Add(e.conflictHorizon()), &s, nil)
+	if err != nil {
+		log.Errorf("Error checking for schedule conflicts: %s", err.Error())
+		return err
+	}
+	if len(conflicts) > 0 {
+		return conflictError{conflicts}
+	}
+	return nil
+}
+
+// checkExceptionConflicts rejects moving an occurrence of a stream to when an
+// exclusive resource it needs is in use by another stream. Conflicts of the
+// stream's other occurrences are left alone, so they can still be resolved by
+// cancelling or moving them.
+func (e *env) checkExceptionConflicts(s stream, ex streamException) error {
+	if !ex.StartAt.Valid {
+		return nil
+	}
+	now := time.Now()
+	conflicts, err := e.scheduleConflicts(now, now.Add(e.conflictHorizon()), &s, &ex)
+	if err != nil {
+		log.Errorf("Error checking for schedule conflicts: %s", err.Error())
+		return err
+	}
+	moved := make([]scheduleConflict, 0)
+	for _, c := range conflicts {
+		if c.Streams[0].Start.Equal(ex.StartAt.Time) {
+			moved = append(moved, c)
+		}
+	}
+	if len(moved) > 0 {
+		return conflictError{moved}
+	}
+	return nil
+}
+
+// Lists existing conflicts between the "from" and "to" query parameters, which default to now and
+// the conflict horizon.
+func getConflictsHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	from, err := parseTimeParam(r, "from", time.Now())
+	if err != nil {
+		return err
+	}
+	to, err := parseTimeParam(r, "to", from.Add(e.conflictHorizon()))
+	if err != nil {
+		return err
+	}
+	if !to.After(from) {
+		return statusError{
+			400,
+			errors.New("to must be after from"),
+		}
+	}
+
+	conflicts, err := e.scheduleConflicts(from, to, nil, nil)
+	if err != nil {
+		requestLog(r).Errorf("Error checking for schedule conflicts: %s", err.Error())
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(conflicts); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	eventPublisherDropped eventType = "publisher_dropped"
+	eventClientDropped    eventType = "client_dropped"
+)
+
+var controlClient = &http.Client{Timeout: 10 * time.Second}
+
+// rtmpApp returns the nginx-rtmp application name from a node's RTMP URL,
+// e.g. "live" for rtmp://ingest.example.com/live
+func rtmpApp(n node) string {
+	u, err := url.Parse(n.RTMPURL)
+	if err != nil {
+		return ""
+	}
+	return path.Base(strings.TrimSuffix(u.Path, "/"))
+}
+
+// controlDrop calls one of the drop endpoints of nginx-rtmp's control module
+// on a node, and returns the number of clients it dropped
+func controlDrop(n node, what string, params url.Values) (int, error) {
+	if n.ControlURL == "" {
+		return 0, fmt.Errorf("Node %s has no control URL", n.Name)
+	}
+	params.Set("app", rtmpApp(n))
+	u := strings.TrimSuffix(n.ControlURL, "/") + "/drop/" + what + "?" + params.Encode()
+
+	resp, err := controlClient.Get(u)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Control module on %s returned %s", n.Name, resp.Status)
+	}
+
+	// The control module responds with the number of dropped clients
+	dropped, err := strconv.Atoi(strings.TrimSpace(string(body)))
+	if err != nil {
+		return 0, fmt.Errorf("Unexpected response from control module on %s: %q", n.Name, body)
+	}
+	return dropped, nil
+}
+
+// hostingNode returns the node a stream is currently live on
+func (e *env) hostingNode(s stream) (node, error) {
+	var n node
+	ls, ok := e.live.get(s.StreamName)
+	if !ok {
+		return n, statusError{
+			http.StatusConflict,
+			errors.New("Stream is not live"),
+		}
+	}
+	err := e.db.Get(&n, `SELECT name, rtmp_url, control_url FROM nodes WHERE name = $1`, ls.Node)
+	if err == sql.ErrNoRows {
+		return n, statusError{
+			http.StatusConflict,
+			fmt.Errorf("Stream is live on unregistered node %s", ls.Node),
+		}
+	}
+	return n, err
+}
+
+type dropResult struct {
+	StreamName string `json:"stream_name"`
+	Node       string `json:"node"`
+	ClientID   string `json:"client_id,omitempty"`
+	Dropped    int    `json:"dropped"`
+	Actor      string `json:"actor"`
+}
+
+// Drops the publisher of a live stream from the node hosting it
+func dropPublisherHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	s, err := e.streamByID(r, mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	n, err := e.hostingNode(s)
+	if err != nil {
+		return err
+	}
+
+	dropped, err := controlDrop(n, "publisher", url.Values{"name": {s.StreamName}})
+	if err != nil {
+		requestLog(r).Errorf("Error dropping publisher of %s: %s", s.StreamName, err.Error())
+		return statusError{
+			http.StatusBadGateway,
+			err,
+		}
+	}
+
+	result := dropResult{s.StreamName, n.Name, "", dropped, actorFromRequest(r)}
+	e.audit(result.Actor, "drop_publisher", s.StreamName, fmt.Sprintf("node=%s dropped=%d", n.Name, dropped))
+	if dropped == 0 {
+		return statusError{
+			http.StatusNotFound,
+			fmt.Errorf("No publisher for %s on node %s", s.StreamName, n.Name),
+		}
+	}
+
+	e.publishEvent(eventPublisherDropped, result)
+	e.setStreamOffline(s.StreamName)
+
+	if err := json.NewEncoder(w).Encode(&result); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+	}
+	return nil
+}
+
+// Drops a single client, publisher or viewer, of a live stream by its nginx-rtmp client id
+func dropClientHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	s, err := e.streamByID(r, vars["id"])
+	if err != nil {
+		return err
+	}
+	n, err := e.hostingNode(s)
+	if err != nil {
+		return err
+	}
+
+	clientID := vars["clientid"]
+	dropped, err := controlDrop(n, "client", url.Values{"name": {s.StreamName}, "clientid": {clientID}})
+	if err != nil {
+		requestLog(r).Errorf("Error dropping client %s of %s: %s", clientID, s.StreamName, err.Error())
+		return statusError{
+			http.StatusBadGateway,
+			err,
+		}
+	}
+
+	result := dropResult{s.StreamName, n.Name, clientID, dropped, actorFromRequest(r)}
+	e.audit(result.Actor, "drop_client", s.StreamName, fmt.Sprintf("node=%s clientid=%s dropped=%d", n.Name, clientID, dropped))
+	if dropped == 0 {
+		return statusError{
+			http.StatusNotFound,
+			fmt.Errorf("No client %s for %s on node %s", clientID, s.StreamName, n.Name),
+		}
+	}
+
+	e.publishEvent(eventClientDropped, result)
+
+	if err := json.NewEncoder(w).Encode(&result); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestControlDrop(t *testing.T) {
+	tests := []struct {
+		what    string
+		params  url.Values
+		query   url.Values
+		respond func(w http.ResponseWriter)
+		dropped int
+		wantErr bool
+	}{
+		{
+			what:    "publisher",
+			params:  url.Values{"name": {"studio"}},
+			query:   url.Values{"app": {"live"}, "name": {"studio"}},
+			respond: func(w http.ResponseWriter) { fmt.Fprintln(w, "1") },
+			dropped: 1,
+		},
+		{
+			what:    "client",
+			params:  url.Values{"name": {"studio"}, "clientid": {"42"}},
+			query:   url.Values{"app": {"live"}, "name": {"studio"}, "clientid": {"42"}},
+			respond: func(w http.ResponseWriter) { fmt.Fprint(w, "0") },
+			dropped: 0,
+		},
+		{
+			what:    "publisher",
+			params:  url.Values{"name": {"studio"}},
+			query:   url.Values{"app": {"live"}, "name": {"studio"}},
+			respond: func(w http.ResponseWriter) { http.Error(w, "1", http.StatusInternalServerError) },
+			wantErr: true,
+		},
+		{
+			what:    "publisher",
+			params:  url.Values{"name": {"studio"}},
+			query:   url.Values{"app": {"live"}, "name": {"studio"}},
+			respond: func(w http.ResponseWriter) { fmt.Fprint(w, "<html>") },
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		var gotPath string
+		var gotQuery url.Values
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotPath, gotQuery = r.URL.Path, r.URL.Query()
+			tt.respond(w)
+		}))
+		n := node{Name: "ingest1", RTMPURL: "rtmp://ingest1.example.com/live/", ControlURL: srv.URL + "/control/"}
+
+		dropped, err := controlDrop(n, tt.what, tt.params)
+		srv.Close()
+
+		if wantPath := "/control/drop/" + tt.what; gotPath != wantPath {
+			t.Errorf("drop %s: requested %s, want %s", tt.what, gotPath, wantPath)
+		}
+		if gotQuery.Encode() != tt.query.Encode() {
+			t.Errorf("drop %s: query %s, want %s", tt.what, gotQuery.Encode(), tt.query.Encode())
+		}
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("drop %s: expected an error, got %d dropped", tt.what, dropped)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("drop %s: %s", tt.what, err)
+		} else if dropped != tt.dropped {
+			t.Errorf("drop %s: dropped %d, want %d", tt.what, dropped, tt.dropped)
+		}
+	}
+}
+
+func TestControlDropNoURL(t *testing.T) {
+	if _, err := controlDrop(node{Name: "ingest1"}, "publisher", url.Values{}); err == nil {
+		t.Error("Expected an error for a node without a control URL")
+	}
+}
+
+func TestControlDropTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	timeout := controlClient.Timeout
+	controlClient.Timeout = 50 * time.Millisecond
+	defer func() { controlClient.Timeout = timeout }()
+
+	n := node{Name: "ingest1", RTMPURL: "rtmp://ingest1.example.com/live", ControlURL: srv.URL}
+	start := time.Now()
+	_, err := controlDrop(n, "publisher", url.Values{"name": {"studio"}})
+	if err == nil {
+		t.Fatal("Expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("controlDrop took %s to give up, despite a %s timeout", elapsed, controlClient.Timeout)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/handlers"
+	log "github.com/sirupsen/logrus"
+)
+
+// Used for policies which don't list their own methods or headers
+var (
+	defaultPublicCORSMethods = []string{"GET", "HEAD"}
+	defaultAdminCORSMethods  = []string{"GET", "HEAD", "POST", "PUT", "DELETE"}
+	defaultPublicCORSHeaders = []string{}
+	defaultAdminCORSHeaders  = []string{"Authorization", "Content-Type", "X-Request-ID"}
+)
+
+// corsConfig is which websites may use a set of endpoints from a visitor's
+// browser. Websocket upgrades are held to the same origins.
+type corsConfig struct {
+	Origins     []string // Allowed origins, such as https://example.com. "*" allows any, for development
+	Methods     []string // Allowed methods
+	Headers     []string // Allowed request headers
+	Credentials bool     // Allow cookies and HTTP authentication to be sent
+}
+
+// allowsOrigin returns true if the policy lists an origin, or allows any
+func (c *corsConfig) allowsOrigin(origin string) bool {
+	for _, o := range c.Origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin decides whether to accept a websocket upgrade. Browsers always
+// send an Origin, so connections without one are from other programs, and
+// are allowed, as are connections from a page on the same host.
+func (c *corsConfig) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || c.allowsOrigin(origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	requestLog(r).Warnf("Rejected websocket from origin %s", origin)
+	return false
+}
+
+// handler wraps h with the policy, using the given methods and headers if it
+// doesn't list its own
+func (c *corsConfig) handler(h http.Handler, methods, headers []string) http.Handler {
+	if len(c.Methods) > 0 {
+		methods = c.Methods
+	}
+	if len(c.Headers) > 0 {
+		headers = c.Headers
+	}
+	opts := []handlers.CORSOption{
+		handlers.AllowedOriginValidator(c.allowsOrigin),
+		handlers.AllowedMethods(methods),
+		handlers.AllowedHeaders(headers),
+	}
+	if c.Credentials {
+		opts = append(opts, handlers.AllowCredentials())
+	}
+	return handlers.CORS(opts...)(h)
+}
+
+// corsMiddleware applies the admin policy to the authenticated API, and the
+// public policy to everything else browsers may use. The RPC endpoints are
+// only for ingest nodes, so get no CORS headers at all.
+func corsMiddleware(public, admin corsConfig) func(http.Handler) http.Handler {
+	for name, c := range map[string]corsConfig{"public": public, "admin": admin} {
+		if c.Credentials && c.allowsOrigin("*") {
+			log.Warnf("The %s CORS policy allows credentials from any origin. Only do this for development", name)
+		}
+	}
+	return func(h http.Handler) http.Handler {
+		publicHandler := public.handler(h, defaultPublicCORSMethods, defaultPublicCORSHeaders)
+		adminHandler := admin.handler(h, defaultAdminCORSMethods, defaultAdminCORSHeaders)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasPrefix(r.URL.Path, "/v1/rpc/"), r.URL.Path == "/v1/ws/streamstatus":
+				h.ServeHTTP(w, r)
+			case strings.HasPrefix(r.URL.Path, "/v1/api/"):
+				w.Header().Add("Vary", "Origin") // The allowed origin is echoed back, so caches must key on it
+				adminHandler.ServeHTTP(w, r)
+			default:
+				w.Header().Add("Vary", "Origin")
+				publicHandler.ServeHTTP(w, r)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/context"
+	log "github.com/sirupsen/logrus"
+)
+
+// Problem type URIs, for errors clients may want to handle specially. Other
+// errors use about:blank, meaning the status code says all there is to say.
+const (
+	problemValidation = "urn:nexus-server:problem:validation"
+	problemConflict   = "urn:nexus-server:problem:schedule-conflict"
+	problemDuplicate  = "urn:nexus-server:problem:duplicate"
+	problemInternal   = "urn:nexus-server:problem:internal"
+)
+
+// Error response formats, most preferred first
+var errorContentTypes = []string{"application/problem+json", "application/json", "text/plain"}
+
+// An incoming request ID is only reused if it's short and harmless to log
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// problem is an RFC 7807 problem details object
+type problem struct {
+	Type      string             `json:"type"`
+	Title     string             `json:"title"`
+	Status    int                `json:"status"`
+	Detail    string             `json:"detail,omitempty"`
+	Instance  string             `json:"instance,omitempty"`
+	RequestID string             `json:"request_id,omitempty"`
+	Fields    []fieldError       `json:"fields,omitempty"`    // Request body validation failures, or duplicated fields
+	Conflicts []scheduleConflict `json:"conflicts,omitempty"` // Schedule conflicts a change would cause
+}
+
+// duplicateError is returned when a field which must be unique has the same
+// value as another object's
+type duplicateError struct {
+	field string
+	msg   string
+}
+
+func (d duplicateError) Error() string {
+	return d.field + " " + d.msg
+}
+
+func (d duplicateError) Status() int {
+	return http.StatusConflict
+}
+
+// requestIDMiddleware gives every request an ID, which is returned in the
+// X-Request-ID header and included in errors and logs. A client or proxy may
+// supply its own.
+func requestIDMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			b := make([]byte, 8)
+			if _, err := rand.Read(b); err != nil {
+				log.Errorf("Unable to generate request ID: %s", err.Error())
+			}
+			id = hex.EncodeToString(b)
+		}
+		context.Set(r, requestIDContextKey, id)
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestID returns the ID of a request, or an empty string
+func requestID(r *http.Request) string {
+	id, _ := context.Get(r, requestIDContextKey).(string)
+	return id
+}
+
+// negotiateErrorType chooses the error format to send, given an Accept header
+func negotiateErrorType(accept string) string {
+	if accept == "" {
+		return errorContentTypes[0]
+	}
+	best, bestQ := "", 0.0
+	for _, ct := range errorContentTypes {
+		q := acceptQuality(accept, ct)
+		if q > bestQ {
+			best, bestQ = ct, q
+		}
+	}
+	if best == "" {
+		return errorContentTypes[len(errorContentTypes)-1] // Nothing acceptable, so fall back to plain text
+	}
+	return best
+}
+
+// acceptQuality returns the quality an Accept header gives a content type,
+// using the most specific matching media range
+func acceptQuality(accept, contentType string) float64 {
+	mainType := strings.SplitN(contentType, "/", 2)[0]
+	q, specificity := 0.0, -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		mr := strings.ToLower(strings.TrimSpace(params[0]))
+		s := -1
+		switch mr {
+		case contentType:
+			s = 2
+		case mainType + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, 1
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+	}
+	return q
+}
+
+// notFoundHandler answers requests which match no route
+func notFoundHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	return statusError{
+		http.StatusNotFound,
+		errors.New("No such endpoint"),
+	}
+}
+
+// writeError sends an error response in the format the client prefers.
+// Internal errors are logged with the request ID, and their details are not
+// sent to the client.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	p := problem{
+		Type:      "about:blank",
+		Instance:  r.URL.Path,
+		RequestID: requestID(r),
+	}
+
+	switch e := err.(type) {
+	case validationError:
+		p.Type, p.Status, p.Detail, p.Fields = problemValidation, e.Status(), e.Error(), e.fields
+	case conflictError:
+		p.Type, p.Status, p.Detail, p.Conflicts = problemConflict, e.Status(), e.Error(), e.conflicts
+	case duplicateError:
+		p.Type, p.Status, p.Detail, p.Fields = problemDuplicate, e.Status(), e.Error(), []fieldError{{e.field, e.msg}}
+	case appError:
+		p.Status, p.Detail = e.Status(), e.Error()
+	default:
+		p.Type, p.Status = problemInternal, http.StatusInternalServerError
+		p.Detail = "An internal error occurred. Quote request ID " + p.RequestID + " when reporting it"
+	}
+	p.Title = http.StatusText(p.Status)
+
+	if p.Status >= 500 {
+		requestLog(r).Errorf("%s %s failed: %s", r.Method, r.URL.Path, err.Error())
+	} else {
+		requestLog(r).Infof("%s %s: %d %s", r.Method, r.URL.Path, p.Status, err.Error())
+	}
+
+	contentType := negotiateErrorType(r.Header.Get("Accept"))
+	var body interface{}
+	switch contentType {
+	case "application/problem+json":
+		body = p
+	case "application/json":
+		body = apiErrorBody{p.Detail, p.Fields}
+	default:
+		http.Error(w, p.Detail, p.Status)
+		return
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		// Drop through and fall back to text response
+		requestLog(r).Warnf("Unable to encode error JSON! %s", err.Error())
+		http.Error(w, p.Detail, p.Status)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	w.Write(append(b, '\n'))
+}
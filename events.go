@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// eventType names a kind of event. Each has its own type of data.
+type eventType string
+
+const (
+	eventNodeStatus   eventType = "node_status"
+	eventMissedEvents eventType = "missed_events" // Sent to a client before the messages after a gap
+)
+
+// event is a server-generated notification, passed to subscribers of the bus
+// and sent to clients of the updates hub
+type event struct {
+	Type eventType   `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// missedEventsEvent tells a client it was too slow and missed messages, so it
+// should fetch the current state again
+type missedEventsEvent struct {
+	Missed int `json:"missed"`
+}
+
+// publishEvent publishes an event to the bus. It never blocks.
+func (e *env) publishEvent(t eventType, data interface{}) {
+	e.bus.publish(t, data)
+}
+
+// subscribe connects the parts of the server which act on events to the bus
+func (e *env) subscribe() {
+	e.bus.subscribe("updates_hub", e.broadcastEvent)
+	e.bus.subscribe("metrics", countEvent)
+	e.bus.subscribe("live_registry", e.live.recordPublish, eventStreamStatus)
+	for i, n := range e.alerts.notifiers {
+		n := n
+		e.bus.subscribe(fmt.Sprintf("notifier_%d", i), func(ev event) {
+			a := ev.Data.(alert)
+			if err := n.notify(ev.Type, a); err != nil {
+				alertsLog.Errorf("Error delivering alert %s for %s: %s", a.Rule, a.Target, err.Error())
+			}
+		}, eventAlertFired, eventAlertResolved)
+	}
+}
+
+// broadcastEvent sends an event to all clients connected to the updates hub
+func (e *env) broadcastEvent(ev event) {
+	b, err := json.Marshal(&ev)
+	if err != nil {
+		busLog.Errorf("Error encoding %s event: %s", ev.Type, err.Error())
+		return
+	}
+	e.updatesWSHub.broadcast <- b
+}
+
+// countEvent updates the metrics which follow from events
+func countEvent(ev event) {
+	switch ev.Type {
+	case eventStreamState:
+		streamTransitionsTotal.inc(string(ev.Data.(*streamTransition).To))
+	case eventPublishFailed:
+		publishFailures.inc(ev.Data.(publishFailedEvent).Reason)
+	case eventPublishLockout:
+		publishLockouts.inc(ev.Data.(*lockout).Scope)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+var errNotFLV = errors.New("Not an FLV file")
+
+// flvDuration works out the duration of an FLV recording by walking its tag
+// headers and finding the latest timestamp. nginx-rtmp doesn't report the
+// duration of a recording, and the onMetaData it writes is empty.
+func flvDuration(path string) (time.Duration, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, err
+	}
+	if string(header[:3]) != "FLV" {
+		return 0, errNotFLV
+	}
+	offset := int64(binary.BigEndian.Uint32(header[5:9]))
+
+	// Each tag is preceded by the 4-byte size of the previous tag, and starts
+	// with an 11-byte header: type, 24-bit data size, 24-bit timestamp,
+	// 8-bit timestamp extension and 24-bit stream id.
+	var latest uint32
+	tag := make([]byte, 11)
+	for {
+		if _, err := f.Seek(offset+4, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(f, tag); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break // Last tag may be truncated if nginx was killed mid-write
+		} else if err != nil {
+			return 0, err
+		}
+		size := uint32(tag[1])<<16 | uint32(tag[2])<<8 | uint32(tag[3])
+		ts := uint32(tag[7])<<24 | uint32(tag[4])<<16 | uint32(tag[5])<<8 | uint32(tag[6])
+		if ts > latest {
+			latest = ts
+		}
+		offset += 4 + 11 + int64(size)
+	}
+	return time.Duration(latest) * time.Millisecond, nil
+}
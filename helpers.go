@@ -1,7 +1,9 @@
 package main
 
 import (
-	"math/rand"
+	"database/sql/driver"
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -30,12 +32,55 @@ func (nt *nullTime) MarshalJSON() ([]byte, error) {
 	return nt.Time.MarshalJSON()
 }
 
-func randomString(length int) string {
-	rand.Seed(time.Now().UTC().UnixNano())
-	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
-	result := make([]byte, length)
-	for i := 0; i < length; i++ {
-		result[i] = chars[rand.Intn(len(chars))]
+func (nt *nullTime) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		nt.Valid = false
+		return nil
 	}
-	return string(result)
+	if err := nt.Time.UnmarshalJSON(b); err != nil {
+		return err
+	}
+	nt.Valid = true
+	return nil
+}
+
+// duration wraps time.Duration so it can be read from the config file as a
+// string such as "30s"
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// stringList is a list of strings stored in a single comma-separated column
+type stringList []string
+
+func (l stringList) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+func (l *stringList) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case nil:
+	default:
+		return errors.New("Unsupported type for string list")
+	}
+	*l = stringList{}
+	if s != "" {
+		*l = strings.Split(s, ",")
+	}
+	return nil
 }
@@ -1,39 +1,132 @@
 package main
 
 import (
-	"github.com/gorilla/websocket"
+	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// What a hub does when a client's queue is full
+const (
+	hubPolicyDisconnect = "disconnect"  // Close the connection, with a reason
+	hubPolicyDropOldest = "drop_oldest" // Drop the oldest queued message
+	hubPolicyCoalesce   = "coalesce"    // Replace an older message about the same stream, or else drop the oldest
+
+	defaultHubBuffer = 256
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+var (
+	hubDropped = newCounter("nexus_ws_dropped_total",
+		"Messages dropped because a websocket client was too slow to receive them, by hub", "hub")
+	hubCoalesced = newCounter("nexus_ws_coalesced_total",
+		"Messages replaced by a later message about the same stream, by hub", "hub")
+	hubSlowDisconnects = newCounter("nexus_ws_slow_disconnects_total",
+		"Websocket clients disconnected for being too slow, by hub", "hub")
+)
+
+// hubConfig is how a hub treats clients which can't keep up
+type hubConfig struct {
+	Policy string // disconnect, drop_oldest or coalesce
+	Buffer int    // Messages queued per client before the policy applies
+}
+
+func (c *hubConfig) validate(name string) error {
+	switch c.Policy {
+	case "", hubPolicyDisconnect, hubPolicyDropOldest, hubPolicyCoalesce:
+	default:
+		return fmt.Errorf("Policy of %s hub must be disconnect, drop_oldest or coalesce, not %s", name, c.Policy)
+	}
+	if c.Buffer < 0 {
+		return fmt.Errorf("Buffer of %s hub can't be negative", name)
+	}
+	return nil
 }
 
 type Message struct {
 	data       []byte
 	remoteAddr net.Addr
+	node       string     // The ingest node which sent the message, if authenticated as one
+	log        *log.Entry // Tagged with the ID of the request which opened the connection
+	client     *Client
+}
+
+// reply sends data back to the client a message came from. Only the hub's
+// incoming handler may call it, as it runs in the hub's goroutine.
+func (m *Message) reply(data []byte) {
+	h := m.client.hub
+	if _, ok := h.clients[m.client]; !ok {
+		return
+	}
+	h.send(m.client, queued{h.coalesceKey(data), data})
+}
+
+// hubClient is the state of a client connected to a hub
+type hubClient struct {
+	RemoteAddr  string    `json:"remote_addr"`
+	RequestID   string    `json:"request_id"`
+	Node        string    `json:"node,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Queued      int       `json:"queued"`
+	Dropped     int       `json:"dropped"`
+	Coalesced   int       `json:"coalesced"`
+}
+
+// hubStatus is the state of a hub and its clients
+type hubStatus struct {
+	Name            string      `json:"name"`
+	Policy          string      `json:"policy"`
+	Buffer          int         `json:"buffer"`
+	Clients         []hubClient `json:"clients"`
+	SlowDisconnects int         `json:"slow_disconnects"` // Since the server started
 }
 
 type Hub struct {
-	clients    map[*Client]bool
-	broadcast  chan []byte
-	register   chan *Client
-	unregister chan *Client
-	incoming   chan *Message
+	name            string
+	policy          string
+	buffer          int
+	clients         map[*Client]bool
+	broadcast       chan []byte
+	register        chan *Client
+	unregister      chan *Client
+	incoming        chan *Message
 	incomingHandler func(*Message)
+	status          chan chan hubStatus
+	upgrader        websocket.Upgrader
+	slowDisconnects int
 }
 
-func newHub() *Hub {
-	return &Hub{
+// newHub creates a hub, which accepts websockets from browsers at the origins
+// allowed by checkOrigin
+func newHub(name string, conf hubConfig, checkOrigin func(*http.Request) bool) *Hub {
+	h := &Hub{
+		name:   name,
+		policy: conf.Policy,
+		buffer: conf.Buffer,
+		upgrader: websocket.Upgrader{
+			CheckOrigin:     checkOrigin,
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+		},
 		broadcast:  make(chan []byte),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[*Client]bool),
 		incoming:   make(chan *Message),
+		status:     make(chan chan hubStatus),
+	}
+	if h.policy == "" {
+		h.policy = hubPolicyDisconnect
+	}
+	if h.buffer == 0 {
+		h.buffer = defaultHubBuffer
 	}
+	return h
 }
 
 func (h *Hub) setIncomingHandler(handler func(*Message)) {
@@ -49,34 +142,126 @@ func (h *Hub) run() {
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
-				close(client.send)
+				client.queue.close(websocket.CloseNormalClosure, "")
 			}
 		case message := <-h.broadcast:
+			m := queued{h.coalesceKey(message), message}
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
+				h.send(client, m)
 			}
 		case msg := <-h.incoming:
 			if h.incomingHandler != nil {
 				h.incomingHandler(msg)
 			}
+		case reply := <-h.status:
+			reply <- h.snapshot()
 		}
 	}
 }
 
-func (h *Hub) handleRequest(w http.ResponseWriter, r *http.Request) error {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// send queues a message for a client, applying the hub's policy if the client
+// has fallen behind
+func (h *Hub) send(c *Client, m queued) {
+	switch c.queue.push(m, h.policy) {
+	case pushDropped:
+		c.dropped++
+		hubDropped.inc(h.name)
+	case pushCoalesced:
+		c.coalesced++
+		hubCoalesced.inc(h.name)
+	case pushFull:
+		delete(h.clients, c)
+		c.queue.close(websocket.CloseTryAgainLater, "Too slow to receive messages")
+		h.slowDisconnects++
+		hubSlowDisconnects.inc(h.name)
+		c.log.Warnf("Disconnected websocket from %s, which was too slow to receive messages", c.conn.RemoteAddr())
+	}
+}
+
+// coalesceKey returns what a message is about, so older messages about the
+// same thing can be replaced by it. Only events about a stream have a key.
+func (h *Hub) coalesceKey(message []byte) string {
+	if h.policy != hubPolicyCoalesce {
+		return ""
+	}
+	var e struct {
+		Type string `json:"type"`
+		Data struct {
+			StreamName string `json:"stream_name"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(message, &e); err != nil || e.Data.StreamName == "" {
+		return ""
+	}
+	return e.Type + "/" + e.Data.StreamName
+}
+
+// snapshot returns the state of the hub. It must run in the hub's goroutine.
+func (h *Hub) snapshot() hubStatus {
+	s := hubStatus{
+		Name:            h.name,
+		Policy:          h.policy,
+		Buffer:          h.buffer,
+		Clients:         make([]hubClient, 0, len(h.clients)),
+		SlowDisconnects: h.slowDisconnects,
+	}
+	for c := range h.clients {
+		s.Clients = append(s.Clients, hubClient{
+			RemoteAddr:  c.conn.RemoteAddr().String(),
+			RequestID:   c.requestID,
+			Node:        c.node,
+			ConnectedAt: c.connected,
+			Queued:      c.queue.len(),
+			Dropped:     c.dropped,
+			Coalesced:   c.coalesced,
+		})
+	}
+	sort.Slice(s.Clients, func(i, j int) bool { return s.Clients[i].ConnectedAt.Before(s.Clients[j].ConnectedAt) })
+	return s
+}
+
+// getStatus asks the hub's goroutine for the state of the hub
+func (h *Hub) getStatus() hubStatus {
+	reply := make(chan hubStatus)
+	h.status <- reply
+	return <-reply
+}
+
+// handleRequest upgrades a request to a websocket, and serves it until it
+// closes. node is the ingest node the client authenticated as, if any.
+func (h *Hub) handleRequest(w http.ResponseWriter, r *http.Request, node string) error {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return err
 	}
-	client := &Client{hub: h, conn: conn, send: make(chan []byte, 256)}
+	client := &Client{
+		hub:       h,
+		conn:      conn,
+		queue:     newSendQueue(h.buffer),
+		node:      node,
+		requestID: requestID(r),
+		connected: time.Now(),
+		log:       hubLog.WithField("request_id", requestID(r)),
+	}
+	if node != "" {
+		client.log = client.log.WithField("node", node)
+	}
+	client.log.Debugf("Websocket connected from %s", conn.RemoteAddr())
 	client.hub.register <- client
 	go client.writePump()
 	client.readPump()
 
+	if client.dropped > 0 || client.coalesced > 0 {
+		client.log.Infof("Websocket from %s missed %d message(s) and had %d coalesced", conn.RemoteAddr(), client.dropped, client.coalesced)
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// Returns the backpressure policy and clients of each websocket hub
+func getHubsHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	hubs := []hubStatus{e.updatesWSHub.getStatus(), e.streamStatusWSHub.getStatus()}
+	if err := json.NewEncoder(w).Encode(hubs); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+	}
+	return nil
+}
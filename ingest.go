@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	policySticky      = "sticky"
+	policyRegion      = "region"
+	policyLeastLoaded = "least_loaded"
+)
+
+// What to do when a stream is published to a node other than the one it was
+// assigned to
+const (
+	enforceOff      = "off"
+	enforceReject   = "reject"
+	enforceRedirect = "redirect"
+)
+
+var defaultIngestPolicies = []string{policySticky, policyRegion, policyLeastLoaded}
+
+// ingestRequest is the context an ingest policy makes its decision in
+type ingestRequest struct {
+	stream   stream
+	region   string // Preferred region, if any
+	assigned string // Node the stream is currently assigned to, if any
+}
+
+// ingestPolicy ranks candidate nodes for a stream. Each policy receives the
+// candidates left by the previous policy in the chain, and returns them
+// filtered or reordered by preference. The first node left at the end of the
+// chain is chosen.
+type ingestPolicy interface {
+	rank(req *ingestRequest, candidates []nodeStatus) []nodeStatus
+}
+
+// stickyPolicy keeps a stream on the node it is already assigned to or live
+// on, as long as that node is still a candidate
+type stickyPolicy struct {
+	live *liveRegistry
+}
+
+func (p stickyPolicy) rank(req *ingestRequest, candidates []nodeStatus) []nodeStatus {
+	current := req.assigned
+	if s, ok := p.live.get(req.stream.StreamName); ok {
+		current = s.Node
+	}
+	for _, c := range candidates {
+		if c.Name == current {
+			return []nodeStatus{c}
+		}
+	}
+	return candidates
+}
+
+// regionPolicy prefers nodes in the requested region, falling back to all
+// candidates if there are none
+type regionPolicy struct {
+	defaultRegion string
+}
+
+func (p regionPolicy) rank(req *ingestRequest, candidates []nodeStatus) []nodeStatus {
+	region := req.region
+	if region == "" {
+		region = p.defaultRegion
+	}
+	if region == "" {
+		return candidates
+	}
+	inRegion := make([]nodeStatus, 0)
+	for _, c := range candidates {
+		if strings.EqualFold(c.Region, region) {
+			inRegion = append(inRegion, c)
+		}
+	}
+	if len(inRegion) == 0 {
+		return candidates
+	}
+	return inRegion
+}
+
+// leastLoadedPolicy orders nodes by the fraction of their capacity in use.
+// Nodes without a capacity are treated as having room for one stream.
+type leastLoadedPolicy struct{}
+
+func nodeLoad(n nodeStatus) float64 {
+	capacity := n.Capacity
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return float64(len(n.Streams)) / float64(capacity)
+}
+
+func (leastLoadedPolicy) rank(req *ingestRequest, candidates []nodeStatus) []nodeStatus {
+	sorted := append([]nodeStatus(nil), candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return nodeLoad(sorted[i]) < nodeLoad(sorted[j])
+	})
+	return sorted
+}
+
+// ingestAssigner picks ingest nodes for streams using a chain of policies
+type ingestAssigner struct {
+	policies []ingestPolicy
+	enforce  string
+}
+
+func newIngestAssigner(names []string, defaultRegion, enforce string, live *liveRegistry) (*ingestAssigner, error) {
+	if len(names) == 0 {
+		names = defaultIngestPolicies
+	}
+	a := &ingestAssigner{enforce: enforce}
+	for _, name := range names {
+		switch name {
+		case policySticky:
+			a.policies = append(a.policies, stickyPolicy{live})
+		case policyRegion:
+			a.policies = append(a.policies, regionPolicy{defaultRegion})
+		case policyLeastLoaded:
+			a.policies = append(a.policies, leastLoadedPolicy{})
+		default:
+			return nil, fmt.Errorf("Unknown ingest policy: %s", name)
+		}
+	}
+	switch enforce {
+	case "":
+		a.enforce = enforceOff
+	case enforceOff, enforceReject, enforceRedirect:
+	default:
+		return nil, fmt.Errorf("Unknown ingest enforcement mode: %s", enforce)
+	}
+	return a, nil
+}
+
+// choose returns the best node for a stream. Only healthy nodes with spare
+// capacity, or the node already hosting the stream, are considered.
+func (a *ingestAssigner) choose(req *ingestRequest, nodes []nodeStatus) (nodeStatus, bool) {
+	candidates := make([]nodeStatus, 0, len(nodes))
+	for _, n := range nodes {
+		if !n.Healthy {
+			continue
+		}
+		hosting := false
+		for _, name := range n.Streams {
+			if name == req.stream.StreamName {
+				hosting = true
+			}
+		}
+		if !hosting && n.Capacity > 0 && len(n.Streams) >= n.Capacity {
+			continue
+		}
+		candidates = append(candidates, n)
+	}
+
+	for _, p := range a.policies {
+		if len(candidates) <= 1 {
+			break
+		}
+		candidates = p.rank(req, candidates)
+	}
+	if len(candidates) == 0 {
+		return nodeStatus{}, false
+	}
+	return candidates[0], true
+}
+
+// assignedNode returns the name of the node a stream is assigned to, or an
+// empty string if it has no assignment
+func (e *env) assignedNode(streamID int) (string, error) {
+	var name string
+	err := e.db.Get(&name, `SELECT node FROM ingest_assignments WHERE stream_id = $1`, int64(streamID))
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return name, err
+}
+
+// recordAssignment stores the node a stream has been assigned to
+func (e *env) recordAssignment(streamID int, nodeName string, at time.Time) error {
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM ingest_assignments WHERE stream_id = $1`, int64(streamID))
+	if err == nil {
+		_, err = tx.Exec(`
+			INSERT INTO ingest_assignments (
+				stream_id, node, assigned_at
+			) VALUES (
+				$1, $2, $3
+			)`,
+			int64(streamID), nodeName, at,
+		)
+	}
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// ingestAssignment tells a publisher which node to send a stream to
+type ingestAssignment struct {
+	Node       string    `json:"node"`
+	Region     string    `json:"region"`
+	RTMPURL    string    `json:"rtmp_url"`
+	StreamName string    `json:"stream_name"`
+	PublishURL string    `json:"publish_url"`
+	AssignedAt time.Time `json:"assigned_at"`
+}
+
+// ingestURL joins a node's RTMP application URL with a stream name
+func ingestURL(n node, streamName string) string {
+	return strings.TrimSuffix(n.RTMPURL, "/") + "/" + streamName
+}
+
+// Chooses an ingest node for a stream, records the assignment, and returns
+// the RTMP URL to publish to. Accepts an optional "region" query parameter.
+func getIngestHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	s, err := e.streamByID(r, mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+
+	assigned, err := e.assignedNode(s.ID)
+	if err != nil {
+		requestLog(r).Errorf("Error querying for ingest assignment: %s", err.Error())
+		return err
+	}
+	nodes, err := e.nodeStatuses()
+	if err != nil {
+		requestLog(r).Errorf("Error querying for nodes: %s", err.Error())
+		return err
+	}
+
+	req := &ingestRequest{
+		stream:   s,
+		region:   r.FormValue("region"),
+		assigned: assigned,
+	}
+	n, ok := e.ingest.choose(req, nodes)
+	if !ok {
+		return statusError{
+			http.StatusServiceUnavailable,
+			errors.New("No healthy ingest node available"),
+		}
+	}
+
+	now := time.Now()
+	if err := e.recordAssignment(s.ID, n.Name, now); err != nil {
+		requestLog(r).Errorf("Error recording ingest assignment: %s", err.Error())
+		return err
+	}
+	if n.Name != assigned {
+		requestLog(r).Infof("Assigned stream %s to ingest node %s", s.StreamName, n.Name)
+	}
+
+	err = json.NewEncoder(w).Encode(ingestAssignment{n.Name, n.Region, n.RTMPURL, s.StreamName, ingestURL(n.node, s.StreamName), now})
+	if err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+	}
+	return nil
+}
+
+// checkPublishNode applies the enforcement mode to an on_publish request from
+// the named node. Returns true if the publish may go ahead; otherwise a
+// response has already been written.
+func (e *env) checkPublishNode(w http.ResponseWriter, r *http.Request, s stream, nodeName string) (bool, error) {
+	if e.ingest.enforce == enforceOff || nodeName == "" {
+		return true, nil
+	}
+	assigned, err := e.assignedNode(s.ID)
+	if err != nil {
+		return false, err
+	}
+	if assigned == "" || assigned == nodeName {
+		return true, nil
+	}
+
+	requestLog(r).Warnf("Stream %s published to node %s, but is assigned to %s", s.StreamName, nodeName, assigned)
+	if e.ingest.enforce == enforceRedirect {
+		var n node
+		err := e.db.Get(&n, `SELECT name, rtmp_url FROM nodes WHERE name = $1`, assigned)
+		if err == nil {
+			http.Redirect(w, r, ingestURL(n, s.StreamName), http.StatusFound)
+			return false, nil
+		} else if err != sql.ErrNoRows {
+			return false, err
+		}
+		// Assigned node has since been removed, so fall back to rejecting
+	}
+	w.WriteHeader(http.StatusForbidden)
+	return false, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultKeyLength   = 24
+	defaultKeyAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	// Stored keys are scheme$salt$hash, with the salt and hash hex encoded
+	keyHashScheme = "sha256"
+	keySaltLength = 16
+
+	minKeyEntropy = 96 // Bits
+)
+
+// Key prefixes end up in RTMP URLs, so are kept to characters which needn't be escaped
+var keyPrefixPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]*$`)
+
+// keyGenerator makes random stream keys
+type keyGenerator struct {
+	length   int
+	alphabet string
+	prefix   string // Makes leaked keys easy to spot, e.g. by secret scanners
+}
+
+func newKeyGenerator(length int, alphabet, prefix string) (*keyGenerator, error) {
+	if length <= 0 {
+		length = defaultKeyLength
+	}
+	if alphabet == "" {
+		alphabet = defaultKeyAlphabet
+	}
+	if len(alphabet) < 2 || len(alphabet) > 256 {
+		return nil, errors.New("Key alphabet must have between 2 and 256 characters")
+	}
+	seen := make(map[rune]bool)
+	for _, c := range alphabet {
+		if c > 127 || !keyPrefixPattern.MatchString(string(c)) {
+			return nil, fmt.Errorf("Key alphabet may only contain A-Z, a-z, 0-9, _, . and -, not %q", c)
+		}
+		if seen[c] {
+			return nil, fmt.Errorf("Key alphabet contains %q more than once", c)
+		}
+		seen[c] = true
+	}
+	if !keyPrefixPattern.MatchString(prefix) {
+		return nil, errors.New("Key prefix may only contain A-Z, a-z, 0-9, _, . and -")
+	}
+	if bits := float64(length) * math.Log2(float64(len(alphabet))); bits < minKeyEntropy {
+		log.Warnf("Stream keys only have %.0f bits of entropy. Consider a longer length or alphabet", bits)
+	}
+	return &keyGenerator{length, alphabet, prefix}, nil
+}
+
+// generate returns a new key, chosen uniformly from the alphabet using
+// crypto/rand
+func (k *keyGenerator) generate() (string, error) {
+	// Bytes at or above limit are discarded, so every character is equally likely
+	limit := 256 - 256%len(k.alphabet)
+	result := make([]byte, 0, k.length)
+	buf := make([]byte, k.length)
+	for len(result) < k.length {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(result) < k.length {
+				result = append(result, k.alphabet[int(b)%len(k.alphabet)])
+			}
+		}
+	}
+	return k.prefix + string(result), nil
+}
+
+// hashKey returns the salted hash of a key, as stored in the database
+func hashKey(key string) (string, error) {
+	salt := make([]byte, keySaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append(salt, key...))
+	return keyHashScheme + "$" + hex.EncodeToString(salt) + "$" + hex.EncodeToString(sum[:]), nil
+}
+
+// isHashedKey returns true if a stored key has been hashed
+func isHashedKey(stored string) bool {
+	return strings.HasPrefix(stored, keyHashScheme+"$")
+}
+
+// keyMatches compares a key with a stored hash, in constant time
+func keyMatches(stored, key string) bool {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 3 || parts[0] != keyHashScheme {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	want, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256(append(salt, key...))
+	return subtle.ConstantTimeCompare(sum[:], want) == 1
+}
+
+// newStreamKey generates a key, returning it and its hash
+func (e *env) newStreamKey(r *http.Request) (string, string, error) {
+	key, err := e.keys.generate()
+	if err != nil {
+		requestLog(r).Errorf("Error generating stream key: %s", err.Error())
+		return "", "", err
+	}
+	hash, err := hashKey(key)
+	if err != nil {
+		requestLog(r).Errorf("Error hashing stream key: %s", err.Error())
+		return "", "", err
+	}
+	return key, hash, nil
+}
+
+// migrateStreamKeys hashes any keys still stored in plaintext. Their
+// plaintext keys keep working.
+func migrateStreamKeys(db *sqlx.DB) error {
+	var rows []struct {
+		ID  int    `db:"id"`
+		Key string `db:"key"`
+	}
+	if err := db.Select(&rows, `SELECT id() as id, key FROM streams`); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, row := range rows {
+		if isHashedKey(row.Key) {
+			continue
+		}
+		hash, err := hashKey(row.Key)
+		if err == nil {
+			_, err = tx.Exec(`UPDATE streams SET key = $2 WHERE id() = $1`, int64(row.ID), hash)
+		}
+		if err != nil {
+			if rerr := tx.Rollback(); rerr != nil {
+				return rerr
+			}
+			return err
+		}
+		n++
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Infof("Hashed %d plaintext stream key(s)", n)
+	}
+	return nil
+}
+
+// streamWithKey is a newly created stream, with the only copy of its key
+type streamWithKey struct {
+	stream
+	Key string `json:"key"`
+}
+
+// streamKey is the response of the key rotation endpoint
+type streamKey struct {
+	ID         int    `json:"id"`
+	StreamName string `json:"stream_name"`
+	Key        string `json:"key"`
+}
+
+// Replaces the key of a stream, returning the new key. This is the only time it is shown, so
+// store it somewhere safe. Every rotation is audited.
+func rotateKeyHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	s, err := e.streamByID(r, mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	key, hash, err := e.newStreamKey(r)
+	if err != nil {
+		return err
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE streams SET key = $2 WHERE id() = $1`, int64(s.ID), hash)
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	e.audit(actorFromRequest(r), "rotate_key", s.StreamName, "")
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(streamKey{s.ID, s.StreamName, key}); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestKeyGenerator(t *testing.T) {
+	tests := []struct {
+		length   int
+		alphabet string
+		prefix   string
+		pattern  string
+	}{
+		{0, "", "", `^[A-Za-z0-9]{24}$`},
+		{8, "ab", "", `^[ab]{8}$`},
+		{40, "0123456789abcdef", "nx_", `^nx_[0-9a-f]{40}$`},
+	}
+	for _, test := range tests {
+		k, err := newKeyGenerator(test.length, test.alphabet, test.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		re := regexp.MustCompile(test.pattern)
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			key, err := k.generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !re.MatchString(key) {
+				t.Errorf("Key %q doesn't match %s", key, test.pattern)
+			}
+			seen[key] = true
+		}
+		if test.length != 8 && len(seen) != 100 {
+			t.Errorf("Only %d distinct keys out of 100 matching %s", len(seen), test.pattern)
+		}
+	}
+
+	// Every character of the alphabet turns up, even one which doesn't divide 256
+	k, err := newKeyGenerator(1000, "abc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := k.generate()
+	for _, c := range "abc" {
+		if n := strings.Count(key, string(c)); n < 200 {
+			t.Errorf("%q only appears %d times in 1000 characters", c, n)
+		}
+	}
+}
+
+func TestKeyGeneratorErrors(t *testing.T) {
+	for _, test := range []struct {
+		alphabet string
+		prefix   string
+	}{
+		{"a", ""},
+		{strings.Repeat("a", 257), ""},
+		{"abca", ""},
+		{"ab/", ""},
+		{"abé", ""},
+		{"", "live/"},
+		{"", "a key"},
+	} {
+		if _, err := newKeyGenerator(0, test.alphabet, test.prefix); err == nil {
+			t.Errorf("No error with alphabet %q and prefix %q", test.alphabet, test.prefix)
+		}
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	format := regexp.MustCompile(`^sha256\$[0-9a-f]{32}\$[0-9a-f]{64}$`)
+	a, err := hashKey("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := hashKey("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []string{a, b} {
+		if !format.MatchString(h) {
+			t.Errorf("Hash %q isn't of the form sha256$salt$hash", h)
+		}
+		if !isHashedKey(h) {
+			t.Errorf("Hash %q not recognised as hashed", h)
+		}
+	}
+	if a == b {
+		t.Error("Hashes of the same key aren't salted")
+	}
+	if isHashedKey("secret") {
+		t.Error("Plaintext key recognised as hashed")
+	}
+}
+
+func TestKeyMatches(t *testing.T) {
+	stored, err := hashKey("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(stored, "$")
+
+	tests := []struct {
+		name   string
+		stored string
+		key    string
+		match  bool
+	}{
+		{"Matching", stored, "secret", true},
+		{"Mismatching", stored, "Secret", false},
+		{"Empty key", stored, "", false},
+		{"Plaintext stored", "secret", "secret", false},
+		{"Empty stored", "", "", false},
+		{"Other scheme", "md5$" + parts[1] + "$" + parts[2], "secret", false},
+		{"Missing hash", "sha256$" + parts[1], "secret", false},
+		{"Extra part", stored + "$00", "secret", false},
+		{"Bad salt", "sha256$zz$" + parts[2], "secret", false},
+		{"Bad hash", "sha256$" + parts[1] + "$zz", "secret", false},
+		{"Truncated hash", "sha256$" + parts[1] + "$" + parts[2][:62], "secret", false},
+	}
+	for _, test := range tests {
+		if got := keyMatches(test.stored, test.key); got != test.match {
+			t.Errorf("%s: match is %t, want %t", test.name, got, test.match)
+		}
+	}
+}
+
+func TestMigrateStreamKeys(t *testing.T) {
+	e, cleanup := newTestEnv(t)
+	defer cleanup()
+
+	plain := createStream(t, e, `{"stream_name": "plain", "display_name": "Plain"}`)
+	hashed := createStream(t, e, `{"stream_name": "hashed", "display_name": "Hashed"}`)
+	tx, err := e.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(`UPDATE streams SET key = "oldkey" WHERE id() = $1`, int64(plain.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := func() map[string]string {
+		var rows []struct {
+			Name string `db:"stream_name"`
+			Key  string `db:"key"`
+		}
+		if err := e.db.Select(&rows, `SELECT stream_name, key FROM streams`); err != nil {
+			t.Fatal(err)
+		}
+		result := make(map[string]string)
+		for _, row := range rows {
+			result[row.Name] = row.Key
+		}
+		return result
+	}
+	before := keys()
+
+	// Running again, as every startup does, must leave hashed keys alone
+	var first map[string]string
+	for run := 1; run <= 2; run++ {
+		if err := migrateStreamKeys(e.db); err != nil {
+			t.Fatal(err)
+		}
+		after := keys()
+		if !keyMatches(after["plain"], "oldkey") {
+			t.Errorf("Run %d: plaintext key stored as %q", run, after["plain"])
+		}
+		if after["hashed"] != before["hashed"] || !keyMatches(after["hashed"], hashed.Key) {
+			t.Errorf("Run %d: hashed key changed to %q", run, after["hashed"])
+		}
+		if run == 1 {
+			first = after
+		} else if after["plain"] != first["plain"] {
+			t.Error("Second run hashed a key again")
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// streamState is where a stream is in its lifecycle
+type streamState string
+
+const (
+	stateDraft     streamState = "draft"     // Not scheduled, and not live
+	stateScheduled streamState = "scheduled" // Has a current or upcoming occurrence, but isn't live
+	stateStarting  streamState = "starting"  // A publisher has been accepted, but no node has reported it live
+	stateLive      streamState = "live"
+	stateDegraded  streamState = "degraded" // Live, but with a low bitrate or reconnect alert firing
+	stateEnded     streamState = "ended"    // Was live, or its schedule has passed
+	stateArchived  streamState = "archived" // Retired by hand. Can't be published until restored to draft
+)
+
+const (
+	eventStreamState eventType = "stream_state"
+
+	lifecycleInterval = 30 * time.Second
+	startingTimeout   = time.Minute // How long a stream may be starting without going live
+)
+
+// streamTransitions are the states each state may move to
+var streamTransitions = map[streamState][]streamState{
+	stateDraft:     {stateScheduled, stateStarting, stateLive, stateEnded, stateArchived},
+	stateScheduled: {stateDraft, stateStarting, stateLive, stateEnded, stateArchived},
+	stateStarting:  {stateLive, stateEnded},
+	stateLive:      {stateDegraded, stateEnded},
+	stateDegraded:  {stateLive, stateEnded},
+	stateEnded:     {stateDraft, stateScheduled, stateStarting, stateLive, stateArchived},
+	stateArchived:  {stateDraft},
+}
+
+// States which may be set through the API. The rest follow from the schedule
+// and from ingest.
+var manualStates = []streamState{stateDraft, stateArchived}
+
+// Alerts which mark a live stream as degraded while firing
+var degradingAlerts = []string{alertLowBitrate, alertReconnects}
+
+var streamTransitionsTotal = newCounter("nexus_stream_transitions_total",
+	"Stream lifecycle transitions, by the state moved to", "state")
+
+// canMoveTo returns true if the lifecycle allows moving from s to state
+func (s streamState) canMoveTo(state streamState) bool {
+	for _, t := range streamTransitions[s] {
+		if t == state {
+			return true
+		}
+	}
+	return false
+}
+
+// streamTransition is a recorded change of a stream's state
+type streamTransition struct {
+	StreamID   int         `db:"stream_id" json:"stream_id"`
+	StreamName string      `db:"-" json:"stream_name,omitempty"`
+	From       streamState `db:"from_state" json:"from"`
+	To         streamState `db:"to_state" json:"to"`
+	Reason     string      `db:"reason" json:"reason"`
+	At         time.Time   `db:"at" json:"at"`
+}
+
+// lifecycle serialises state changes, so each is checked against the state
+// it replaces
+type lifecycle struct {
+	mu      sync.Mutex
+	started time.Time
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{started: time.Now()}
+}
+
+// invalidTransitionError is returned for a transition the lifecycle doesn't allow
+type invalidTransitionError struct {
+	from, to streamState
+}
+
+func (e invalidTransitionError) Error() string {
+	return fmt.Sprintf("A %s stream can't become %s", e.from, e.to)
+}
+
+// transitionStream moves a stream to a new state, recording when and why. If
+// any from states are given, the stream is only moved if it is in one of them.
+// Returns the transition, or nil if the stream didn't move.
+func (e *env) transitionStream(name string, to streamState, reason string, from ...streamState) (*streamTransition, error) {
+	e.lifecycle.mu.Lock()
+	defer e.lifecycle.mu.Unlock()
+
+	var current struct {
+		ID    int         `db:"id"`
+		State streamState `db:"state"`
+	}
+	err := e.db.Get(&current, `SELECT id() as id, state FROM streams WHERE stream_name = $1`, name)
+	if err == sql.ErrNoRows {
+		return nil, nil // Nodes may report streams which have been deleted
+	} else if err != nil {
+		return nil, err
+	}
+	if current.State == to {
+		return nil, nil
+	}
+	if len(from) > 0 {
+		matched := false
+		for _, f := range from {
+			matched = matched || f == current.State
+		}
+		if !matched {
+			return nil, nil
+		}
+	}
+	if !current.State.canMoveTo(to) {
+		return nil, invalidTransitionError{current.State, to}
+	}
+
+	t := &streamTransition{current.ID, name, current.State, to, reason, time.Now()}
+	tx, err := e.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`UPDATE streams SET state = $2, state_since = $3 WHERE id() = $1`, int64(t.StreamID), string(to), t.At)
+	if err == nil {
+		_, err = tx.Exec(`
+			INSERT INTO stream_transitions (
+				stream_id, from_state, to_state, reason, at
+			) VALUES (
+				$1, $2, $3, $4, $5
+			)`,
+			int64(t.StreamID), string(t.From), string(t.To), t.Reason, t.At,
+		)
+	}
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return nil, rerr
+		}
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Stream %s is now %s, was %s: %s", name, to, t.From, reason)
+	e.publishEvent(eventStreamState, t)
+	return t, nil
+}
+
+// deriveState moves a stream as ingest or the schedule dictates, logging
+// rather than failing if the lifecycle doesn't allow it
+func (e *env) deriveState(name string, to streamState, reason string, from ...streamState) {
+	if _, err := e.transitionStream(name, to, reason, from...); err != nil {
+		log.Warnf("Unable to move stream %s to %s: %s", name, to, err.Error())
+	}
+}
+
+// scheduledState returns what a stream which isn't live should be, given its
+// schedule: scheduled if it has a current or upcoming occurrence, ended once
+// its schedule has passed, and draft if it has no schedule. A stream which
+// ended during its current occurrence stays ended until the occurrence is over.
+func (e *env) scheduledState(s *stream, now time.Time) (streamState, error) {
+	if !s.StartAt.Valid {
+		if s.State == stateEnded {
+			return stateEnded, nil
+		}
+		return stateDraft, nil
+	}
+	exceptions, err := e.streamExceptions(s.ID)
+	if err != nil {
+		return "", err
+	}
+	lead, overrun := e.conf.Schedule.LeadTime.Duration, e.conf.Schedule.Overrun.Duration
+	o, ok, err := s.currentOccurrence(now, overrun, exceptions)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return stateEnded, nil
+	}
+	if s.State == stateEnded && s.StateSince.Valid && s.StateSince.Time.After(o.Start.Add(-lead)) {
+		return stateEnded, nil
+	}
+	return stateScheduled, nil
+}
+
+// updateScheduledState moves a stream which isn't live to the state its
+// schedule dictates
+func (e *env) updateScheduledState(s *stream, now time.Time) {
+	switch s.State {
+	case stateDraft, stateScheduled, stateEnded:
+	default:
+		return
+	}
+	state, err := e.scheduledState(s, now)
+	if err != nil {
+		log.Warnf("Unable to work out schedule of %s: %s", s.StreamName, err.Error())
+		return
+	}
+	e.deriveState(s.StreamName, state, "schedule", stateDraft, stateScheduled, stateEnded)
+}
+
+// updateStreamStates brings every stream's state up to date with its schedule
+// and the live registry. Streams starting for too long, or left live by a
+// previous run of the server, are ended.
+func (e *env) updateStreamStates() error {
+	streams := make([]stream, 0)
+	if err := e.db.Select(&streams, streamSQL); err != nil {
+		return err
+	}
+	now := time.Now()
+	settled := now.Sub(e.lifecycle.started) > e.nodes.timeout // Nodes have had time to report what is live
+	for i := range streams {
+		s := &streams[i]
+		_, live := e.live.get(s.StreamName)
+		switch {
+		case s.State == stateStarting && !live && now.Sub(s.StateSince.Time) > startingTimeout:
+			e.deriveState(s.StreamName, stateEnded, "not live after starting", stateStarting)
+		case (s.State == stateLive || s.State == stateDegraded) && !live && settled:
+			e.deriveState(s.StreamName, stateEnded, "no longer live", stateLive, stateDegraded)
+		default:
+			e.updateScheduledState(s, now)
+		}
+	}
+	return nil
+}
+
+// updateDegraded marks live streams degraded while a low bitrate or reconnect
+// alert is firing for them, and live again once none are
+func (e *env) updateDegraded() {
+	firing := make(map[string]string)
+	e.alerts.mu.Lock()
+	for _, a := range e.alerts.active {
+		for _, kind := range degradingAlerts {
+			if a.Kind == kind {
+				firing[a.Target] = a.Rule
+			}
+		}
+	}
+	e.alerts.mu.Unlock()
+
+	for _, s := range e.live.list() {
+		if rule, ok := firing[s.Name]; ok {
+			e.deriveState(s.Name, stateDegraded, "alert "+rule, stateLive)
+		} else {
+			e.deriveState(s.Name, stateLive, "alerts resolved", stateDegraded)
+		}
+	}
+}
+
+func (e *env) runLifecycle() {
+	if err := e.updateStreamStates(); err != nil {
+		log.Errorf("Error updating stream states: %s", err.Error())
+	}
+	ticker := time.NewTicker(lifecycleInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := e.updateStreamStates(); err != nil {
+			log.Errorf("Error updating stream states: %s", err.Error())
+		}
+	}
+}
+
+// Returns the state changes of a stream, most recent first
+func getTransitionsHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	s, err := e.streamByID(r, mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	transitions := make([]streamTransition, 0)
+	err = e.db.Select(&transitions, `
+		SELECT
+			stream_id, from_state, to_state, reason, at
+		FROM
+			stream_transitions
+		WHERE stream_id = $1
+		ORDER BY at DESC`,
+		int64(s.ID),
+	)
+	if err != nil {
+		requestLog(r).Errorf("Error querying for stream transitions: %s", err.Error())
+		return err
+	}
+	for i := range transitions {
+		transitions[i].StreamName = s.StreamName
+	}
+
+	if err := json.NewEncoder(w).Encode(transitions); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+	}
+	return nil
+}
+
+// stateChange is a request to set a stream's state by hand
+type stateChange struct {
+	State  streamState `json:"state" openapi:"required,enum=draft|archived"`
+	Reason string      `json:"reason"`
+}
+
+// Archives a stream, or restores it to draft. Other states follow from the
+// schedule and ingest. Audited.
+func setStreamStateHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	s, err := e.streamByID(r, mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	var c stateChange
+	if err := decodeBody(w, r, &c); err != nil {
+		return err
+	}
+	allowed := false
+	for _, m := range manualStates {
+		allowed = allowed || c.State == m
+	}
+	if !allowed {
+		return statusError{
+			400,
+			fmt.Errorf("State may only be set to draft or archived, not %q", c.State),
+		}
+	}
+
+	actor := actorFromRequest(r)
+	reason := "set by " + actor
+	if c.Reason != "" {
+		reason += ": " + c.Reason
+	}
+	t, err := e.transitionStream(s.StreamName, c.State, reason)
+	if terr, ok := err.(invalidTransitionError); ok {
+		return statusError{
+			http.StatusConflict,
+			terr,
+		}
+	} else if err != nil {
+		return err
+	}
+	if t == nil {
+		return statusError{
+			http.StatusConflict,
+			errors.New("Stream is already " + string(c.State)),
+		}
+	}
+	e.audit(actor, "set_stream_state", s.StreamName, string(c.State))
+
+	if c.State == stateDraft {
+		s.State, s.StateSince = stateDraft, toNullTime(t.At)
+		e.updateScheduledState(&s, time.Now())
+	}
+
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+	}
+	return nil
+}
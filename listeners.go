@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+	log "github.com/sirupsen/logrus"
+)
+
+// listenerConfig is where one set of routes is served, and how it's secured
+type listenerConfig struct {
+	Listen   string // host:port, or unix:/path for a Unix socket
+	Cert     string // TLS certificate file. Served over plain HTTP if empty
+	Key      string // TLS private key file
+	ClientCA string // If set, clients must present a certificate signed by one of these CAs
+}
+
+// tlsReloader holds the TLS config of a listener, which is rebuilt from its
+// files on SIGHUP
+type tlsReloader struct {
+	conf listenerConfig
+
+	mu     sync.RWMutex
+	config *tls.Config
+}
+
+func newTLSReloader(conf listenerConfig) (*tlsReloader, error) {
+	t := &tlsReloader{conf: conf}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// reload reads the certificate, key and client CAs again. The previous config
+// is kept if any can't be read.
+func (t *tlsReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(t.conf.Cert, t.conf.Key)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.conf.ClientCA != "" {
+		pem, err := ioutil.ReadFile(t.conf.ClientCA)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("No certificates found in " + t.conf.ClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.config = config
+	return nil
+}
+
+func (t *tlsReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.config, nil
+}
+
+func (t *tlsReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return &t.config.Certificates[0], nil
+}
+
+// server is one of the HTTP listeners
+type server struct {
+	name string
+	conf listenerConfig
+	tls  *tlsReloader // Nil if serving plain HTTP
+	srv  *http.Server
+}
+
+// newServer creates a listener serving the given sets of routes
+func (e *env) newServer(name string, conf listenerConfig, middleware alice.Chain, routes ...func(*mux.Router)) (*server, error) {
+	if conf.Listen == "" {
+		return nil, errors.New("No listen address for " + name + " listener")
+	}
+	if (conf.Cert == "") != (conf.Key == "") {
+		return nil, errors.New("Both cert and key are needed for TLS on " + name + " listener")
+	}
+	if conf.ClientCA != "" && conf.Cert == "" {
+		return nil, errors.New("Client certificates need TLS on " + name + " listener")
+	}
+
+	router := mux.NewRouter()
+	router.KeepContext = true // Cleared by the middleware, once the request has been logged
+	router.NotFoundHandler = appHandler{e, notFoundHandler}
+	for _, r := range routes {
+		r(router)
+	}
+	s := &server{
+		name: name,
+		conf: conf,
+		srv:  &http.Server{Handler: middleware.Then(router)},
+	}
+	if conf.Cert != "" {
+		t, err := newTLSReloader(conf)
+		if err != nil {
+			return nil, err
+		}
+		s.tls = t
+		s.srv.TLSConfig = &tls.Config{
+			GetConfigForClient: t.getConfigForClient,
+			GetCertificate:     t.getCertificate,
+		}
+	}
+	return s, nil
+}
+
+// listen opens the listener's socket, unless systemd passed one with the
+// listener's name. A stale Unix socket left behind by a previous run is
+// removed first.
+func (s *server) listen(activated map[string]net.Listener) (net.Listener, error) {
+	if ln, ok := activated[s.name]; ok {
+		delete(activated, s.name)
+		log.Infof("Using socket passed by systemd for %s listener", s.name)
+		return ln, nil
+	}
+	if strings.HasPrefix(s.conf.Listen, "unix:") {
+		socket := strings.TrimPrefix(s.conf.Listen, "unix:")
+		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", socket)
+	}
+	return net.Listen("tcp", s.conf.Listen)
+}
+
+// serve accepts connections until the server fails
+func (s *server) serve(ln net.Listener) error {
+	if s.tls != nil {
+		log.Infof("Serving %s listener on %s with TLS", s.name, s.conf.Listen)
+		return s.srv.ServeTLS(ln, "", "")
+	}
+	log.Infof("Serving %s listener on %s", s.name, s.conf.Listen)
+	return s.srv.Serve(ln)
+}
+
+// shutdown stops every listener, waiting a while for requests in progress
+func shutdown(servers []*server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.srv.Shutdown(ctx); err != nil {
+			log.Warnf("Error shutting down %s listener: %s", s.name, err.Error())
+		}
+	}
+}
+
+// reloadTLS rereads the TLS files of every listener using TLS
+func reloadTLS(servers []*server) {
+	for _, s := range servers {
+		if s.tls == nil {
+			continue
+		}
+		if err := s.tls.reload(); err != nil {
+			log.Errorf("Error reloading TLS for %s listener, keeping previous certificate: %s", s.name, err.Error())
+		} else {
+			log.Infof("Reloaded TLS for %s listener", s.name)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ystv/nexus-common"
+)
+
+// liveStream is the in-memory state of a stream that is currently being
+// published to one of the ingest nodes
+type liveStream struct {
+	Name  string       `json:"stream_name"`
+	Node  string       `json:"node"`
+	Since time.Time    `json:"since"`
+	Stats *streamStats `json:"stats"` // Latest stats from the node's stat module, if polled
+}
+
+// streamStats are the bitrate and media details of a live stream, as reported
+// by nginx-rtmp's stat module
+type streamStats struct {
+	BitrateIn    int64     `json:"bitrate_in"` // Bits per second
+	BitrateVideo int64     `json:"bitrate_video"`
+	BitrateAudio int64     `json:"bitrate_audio"`
+	Clients      int       `json:"clients"`
+	VideoCodec   string    `json:"video_codec"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	FrameRate    float64   `json:"frame_rate"`
+	AudioCodec   string    `json:"audio_codec"`
+	AudioRate    int       `json:"audio_sample_rate"`
+	Channels     int       `json:"audio_channels"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// sameAs compares stats, ignoring when they were updated
+func (s *streamStats) sameAs(o *streamStats) bool {
+	if s == nil || o == nil {
+		return s == o
+	}
+	a, b := *s, *o
+	a.UpdatedAt, b.UpdatedAt = time.Time{}, time.Time{}
+	return a == b
+}
+
+// liveRegistry keeps track of which streams are live, and where
+type liveRegistry struct {
+	mu        sync.Mutex
+	streams   map[string]*liveStream
+	publishes map[string][]time.Time // When each stream has gone live, for spotting reconnects
+}
+
+// Publishes older than this are forgotten
+const publishHistory = 24 * time.Hour
+
+func newLiveRegistry() *liveRegistry {
+	return &liveRegistry{
+		streams:   make(map[string]*liveStream),
+		publishes: make(map[string][]time.Time),
+	}
+}
+
+// setOnline marks a stream as live on the given node. Returns true if this
+// changed anything.
+func (l *liveRegistry) setOnline(name, node string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if s, ok := l.streams[name]; ok && s.Node == node {
+		return false
+	}
+	l.streams[name] = &liveStream{Name: name, Node: node, Since: time.Now()}
+	return true
+}
+
+// recordPublish remembers when a stream went live, from a stream_status
+// event, for spotting reconnects
+func (l *liveRegistry) recordPublish(ev event) {
+	s := ev.Data.(streamStatusEvent)
+	if s.Status != nexus_common.StreamStatusOnline {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	history := l.publishes[s.StreamName]
+	for len(history) > 0 && ev.Time.Sub(history[0]) > publishHistory {
+		history = history[1:]
+	}
+	l.publishes[s.StreamName] = append(history, ev.Time)
+}
+
+// publishesSince returns the number of times a stream has gone live since t
+func (l *liveRegistry) publishesSince(name string, t time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	for _, at := range l.publishes[name] {
+		if at.After(t) {
+			n++
+		}
+	}
+	return n
+}
+
+// setOffline removes a stream from the registry. Returns true if it was live.
+func (l *liveRegistry) setOffline(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.streams[name]; !ok {
+		return false
+	}
+	delete(l.streams, name)
+	return true
+}
+
+// setStats updates the stats of a live stream. Returns true if they changed.
+func (l *liveRegistry) setStats(name string, stats *streamStats) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s, ok := l.streams[name]
+	if !ok {
+		return false
+	}
+	changed := !s.Stats.sameAs(stats)
+	s.Stats = stats
+	return changed
+}
+
+// list returns a copy of the state of all live streams
+func (l *liveRegistry) list() []liveStream {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	streams := make([]liveStream, 0, len(l.streams))
+	for _, s := range l.streams {
+		streams = append(streams, *s)
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Name < streams[j].Name })
+	return streams
+}
+
+// get returns a copy of the live state of a stream
+func (l *liveRegistry) get(name string) (liveStream, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s, ok := l.streams[name]
+	if !ok {
+		return liveStream{}, false
+	}
+	return *s, true
+}
+
+// onNode returns the names of all streams live on the given node
+func (l *liveRegistry) onNode(node string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	names := make([]string, 0)
+	for name, s := range l.streams {
+		if s.Node == node {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	eventPublishFailed  eventType = "publish_failed"
+	eventPublishLockout eventType = "publish_lockout"
+
+	defaultLockoutMaxFailures = 5
+	defaultLockoutWindow      = 10 * time.Minute
+	defaultLockoutDuration    = time.Minute
+	defaultLockoutMaxDuration = time.Hour
+)
+
+// Lockout scopes. Failures are counted per source address and per stream name.
+// A locked out stream name only turns away attempts without the right key, so
+// guessing keys can't keep its real publisher off air.
+const (
+	lockoutAddr   = "addr"
+	lockoutStream = "stream"
+)
+
+var (
+	publishFailures = newCounter("nexus_publish_failures_total",
+		"Publish attempts rejected for an unknown stream name or wrong key", "reason")
+	publishLockouts = newCounter("nexus_publish_lockouts_total",
+		"Lockouts imposed after repeated failed publish attempts", "scope")
+	publishLockedOut = newCounter("nexus_publish_locked_out_total",
+		"Publish attempts rejected because the address or stream name was locked out", "scope")
+)
+
+// publishFailedEvent is sent to the updates hub when a publish attempt has
+// an unknown stream name or wrong key
+type publishFailedEvent struct {
+	StreamName string `json:"stream_name"`
+	Addr       string `json:"addr"`
+	Reason     string `json:"reason"`
+}
+
+// lockout is the failure record of an address or stream name. It is sent to
+// the updates hub when a lockout is imposed, and listed by the API.
+type lockout struct {
+	Scope       string    `json:"scope"`
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"` // Within the failure window
+	Lockouts    int       `json:"lockouts"` // Consecutive lockouts, each twice as long as the last
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+type guardRecord struct {
+	failures    []time.Time
+	lockouts    int
+	lockedUntil time.Time
+}
+
+// publishGuard counts failed publish attempts, and locks out addresses and
+// stream names with too many of them
+type publishGuard struct {
+	mu          sync.Mutex
+	records     map[string]*guardRecord // Keyed by scope:key
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+	maxDuration time.Duration
+}
+
+func newPublishGuard(maxFailures int, window, duration, maxDuration time.Duration) *publishGuard {
+	if maxFailures == 0 {
+		maxFailures = defaultLockoutMaxFailures
+	}
+	if window <= 0 {
+		window = defaultLockoutWindow
+	}
+	if duration <= 0 {
+		duration = defaultLockoutDuration
+	}
+	if maxDuration <= 0 {
+		maxDuration = defaultLockoutMaxDuration
+	}
+	g := &publishGuard{
+		records:     make(map[string]*guardRecord),
+		maxFailures: maxFailures,
+		window:      window,
+		duration:    duration,
+		maxDuration: maxDuration,
+	}
+	newGaugeFunc("nexus_publish_lockouts_active", "Addresses and stream names currently locked out", func() float64 {
+		return float64(len(g.list(time.Now())))
+	})
+	return g
+}
+
+// lockedUntil returns when the lockout of an address or stream name ends, if
+// it is locked out
+func (g *publishGuard) lockedUntil(scope, key string, now time.Time) (time.Time, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	rec, ok := g.records[scope+":"+key]
+	if !ok || !now.Before(rec.lockedUntil) {
+		return time.Time{}, false
+	}
+	return rec.lockedUntil, true
+}
+
+// fail records a failed attempt. If it brings the failures within the window
+// up to the limit, a lockout is imposed and returned.
+func (g *publishGuard) fail(scope, key string, now time.Time) *lockout {
+	if g.maxFailures < 0 {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	rec, ok := g.records[scope+":"+key]
+	if !ok {
+		rec = &guardRecord{}
+		g.records[scope+":"+key] = rec
+	}
+	rec.failures = append(g.recent(rec, now), now)
+	if len(rec.failures) < g.maxFailures {
+		return nil
+	}
+
+	// Double the lockout for each consecutive one, without overflowing
+	d := g.maxDuration
+	if rec.lockouts < 30 {
+		d = time.Duration(math.Min(float64(g.duration)*math.Pow(2, float64(rec.lockouts)), float64(g.maxDuration)))
+	}
+	rec.lockouts++
+	rec.lockedUntil = now.Add(d)
+	l := &lockout{scope, key, len(rec.failures), rec.lockouts, rec.lockedUntil}
+	rec.failures = nil
+	return l
+}
+
+// succeed forgets the failures of an address or stream name
+func (g *publishGuard) succeed(scope, key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.records, scope+":"+key)
+}
+
+// recent returns the failures of a record within the window
+func (g *publishGuard) recent(rec *guardRecord, now time.Time) []time.Time {
+	i := 0
+	for i < len(rec.failures) && now.Sub(rec.failures[i]) > g.window {
+		i++
+	}
+	return rec.failures[i:]
+}
+
+// list returns the current lockouts, soonest to end first
+func (g *publishGuard) list(now time.Time) []lockout {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	result := make([]lockout, 0)
+	for k, rec := range g.records {
+		if !now.Before(rec.lockedUntil) {
+			continue
+		}
+		scope, key := splitLockoutKey(k)
+		result = append(result, lockout{scope, key, len(g.recent(rec, now)), rec.lockouts, rec.lockedUntil})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].LockedUntil.Before(result[j].LockedUntil) })
+	return result
+}
+
+// clear lifts the lockout of an address or stream name, and forgets its
+// failures. It returns false if there was no lockout.
+func (g *publishGuard) clear(scope, key string, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	rec, ok := g.records[scope+":"+key]
+	if !ok || !now.Before(rec.lockedUntil) {
+		return false
+	}
+	delete(g.records, scope+":"+key)
+	return true
+}
+
+// clearAll lifts all lockouts and forgets all failures
+func (g *publishGuard) clearAll() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.records = make(map[string]*guardRecord)
+}
+
+// prune forgets records with no recent failures, which haven't been locked
+// out for long enough that a further lockout needn't be any longer
+func (g *publishGuard) prune(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for k, rec := range g.records {
+		rec.failures = g.recent(rec, now)
+		if len(rec.failures) == 0 && now.Sub(rec.lockedUntil) > g.maxDuration {
+			delete(g.records, k)
+		}
+	}
+}
+
+func splitLockoutKey(k string) (string, string) {
+	parts := strings.SplitN(k, ":", 2)
+	return parts[0], parts[1]
+}
+
+// pruneLockouts periodically forgets old failed publish attempts
+func (e *env) pruneLockouts() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		e.guard.prune(now)
+	}
+}
+
+// checkLockout rejects a publish attempt from a locked out address, or for a
+// locked out stream name, with a 429 and a Retry-After header. Only the given
+// scopes are checked.
+func (e *env) checkLockout(w http.ResponseWriter, name, addr string, scopes ...string) bool {
+	now := time.Now()
+	for _, scope := range scopes {
+		key := addr
+		if scope == lockoutStream {
+			key = name
+		}
+		if key == "" {
+			continue
+		}
+		if until, locked := e.guard.lockedUntil(scope, key, now); locked {
+			log.Infof("Rejected publish of %s from %s: %s %s is locked out", name, addr, scope, key)
+			publishLockedOut.inc(scope)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(until.Sub(now).Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return false
+		}
+	}
+	return true
+}
+
+// rejectPublish turns away a publish attempt with an unknown stream name or
+// wrong key, once it has been recorded. It gets a 429 if its address or
+// stream name is locked out, and otherwise a 401.
+func (e *env) rejectPublish(w http.ResponseWriter, name, addr, reason string) {
+	e.publishFailed(name, addr, reason)
+	if e.checkLockout(w, name, addr, lockoutAddr, lockoutStream) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+}
+
+// publishFailed records a failed publish attempt against its address and
+// stream name, locking either out if it has failed too often
+func (e *env) publishFailed(name, addr, reason string) {
+	log.Infof("Rejected publish of %s from %s: %s", name, addr, reason)
+	e.publishEvent(eventPublishFailed, publishFailedEvent{name, addr, reason})
+
+	now := time.Now()
+	for _, l := range []struct{ scope, key string }{{lockoutAddr, addr}, {lockoutStream, name}} {
+		if l.key == "" {
+			continue
+		}
+		if lo := e.guard.fail(l.scope, l.key, now); lo != nil {
+			log.Warnf("Locked out %s %s until %s after %d failed publish attempts", lo.Scope, lo.Key, lo.LockedUntil.Format(time.RFC3339), lo.Failures)
+			e.publishEvent(eventPublishLockout, lo)
+		}
+	}
+}
+
+// publishSucceeded forgets the failed attempts of an address and stream name
+func (e *env) publishSucceeded(name, addr string) {
+	e.guard.succeed(lockoutStream, name)
+	if addr != "" {
+		e.guard.succeed(lockoutAddr, addr)
+	}
+}
+
+func getLockoutsHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	if err := json.NewEncoder(w).Encode(e.guard.list(time.Now())); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// Lifts the lockout of a single address or stream name
+func clearLockoutHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	if vars["scope"] != lockoutAddr && vars["scope"] != lockoutStream {
+		return statusError{
+			400,
+			errors.New("Scope must be addr or stream"),
+		}
+	}
+	if !e.guard.clear(vars["scope"], vars["key"], time.Now()) {
+		return statusError{
+			404,
+			errors.New("Not locked out"),
+		}
+	}
+	e.audit(actorFromRequest(r), "clear_lockout", vars["scope"]+":"+vars["key"], "")
+	return nil
+}
+
+// Lifts all lockouts
+func clearLockoutsHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	e.guard.clearAll()
+	e.audit(actorFromRequest(r), "clear_lockouts", "", "")
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGuardFail(t *testing.T) {
+	g := newPublishGuard(3, 10*time.Minute, time.Minute, time.Hour)
+	now := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// Failures outside the window don't count towards a lockout
+	for _, at := range []time.Duration{0, 11 * time.Minute, 12 * time.Minute} {
+		if l := g.fail(lockoutAddr, "192.0.2.1", now.Add(at)); l != nil {
+			t.Fatalf("Locked out after a failure at +%s", at)
+		}
+	}
+	now = now.Add(12 * time.Minute)
+	if _, locked := g.lockedUntil(lockoutAddr, "192.0.2.1", now); locked {
+		t.Fatal("Locked out before any lockout was imposed")
+	}
+
+	l := g.fail(lockoutAddr, "192.0.2.1", now)
+	if l == nil {
+		t.Fatal("Not locked out after three failures within the window")
+	}
+	if l.Scope != lockoutAddr || l.Key != "192.0.2.1" || l.Failures != 3 || l.Lockouts != 1 {
+		t.Errorf("Lockout is %+v", l)
+	}
+	if want := now.Add(time.Minute); !l.LockedUntil.Equal(want) {
+		t.Errorf("Locked until %s, want %s", l.LockedUntil, want)
+	}
+	if until, locked := g.lockedUntil(lockoutAddr, "192.0.2.1", now); !locked || !until.Equal(l.LockedUntil) {
+		t.Errorf("lockedUntil is %s, %t", until, locked)
+	}
+	if _, locked := g.lockedUntil(lockoutAddr, "192.0.2.1", l.LockedUntil); locked {
+		t.Error("Still locked out once the lockout ended")
+	}
+	if _, locked := g.lockedUntil(lockoutStream, "192.0.2.1", now); locked {
+		t.Error("Lockout applied to another scope")
+	}
+	if got := g.list(now); len(got) != 1 || got[0].Key != "192.0.2.1" {
+		t.Errorf("Listed lockouts are %+v", got)
+	}
+}
+
+func TestGuardDisabled(t *testing.T) {
+	g := newPublishGuard(-1, 0, 0, 0)
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		if l := g.fail(lockoutStream, "studio", now); l != nil {
+			t.Fatal("Locked out with lockouts disabled")
+		}
+	}
+}
+
+func TestGuardBackoff(t *testing.T) {
+	g := newPublishGuard(1, time.Minute, time.Minute, 5*time.Minute)
+	now := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// Each consecutive lockout is twice as long as the last, up to the maximum,
+	// even after enough lockouts for doubling to overflow
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i := 0; i < 40; i++ {
+		l := g.fail(lockoutStream, "studio", now)
+		if l == nil {
+			t.Fatalf("Lockout %d not imposed", i+1)
+		}
+		d := want[len(want)-1]
+		if i < len(want) {
+			d = want[i]
+		}
+		if got := l.LockedUntil.Sub(now); got != d {
+			t.Fatalf("Lockout %d lasts %s, want %s", i+1, got, d)
+		}
+		now = l.LockedUntil
+	}
+}
+
+func TestGuardPrune(t *testing.T) {
+	g := newPublishGuard(2, 10*time.Minute, time.Minute, time.Hour)
+	start := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	g.fail(lockoutAddr, "old", start) // A single failure, long ago
+	g.fail(lockoutAddr, "recent", start.Add(2*time.Hour))
+	g.fail(lockoutStream, "backoff", start.Add(90*time.Minute))
+	g.fail(lockoutStream, "backoff", start.Add(90*time.Minute)) // Locked out until 91 minutes
+	g.fail(lockoutStream, "expired", start)
+	g.fail(lockoutStream, "expired", start) // Locked out until 1 minute
+
+	g.prune(start.Add(2*time.Hour + 5*time.Minute))
+	for k, kept := range map[string]bool{
+		lockoutAddr + ":old":         false,
+		lockoutAddr + ":recent":      true, // Still within the window
+		lockoutStream + ":backoff":   true, // Recent enough that another lockout should be longer
+		lockoutStream + ":expired":   false,
+		lockoutStream + ":never-was": false,
+	} {
+		if _, ok := g.records[k]; ok != kept {
+			t.Errorf("%s kept: %t, want %t", k, ok, kept)
+		}
+	}
+
+	// The remaining failure still counts
+	if l := g.fail(lockoutAddr, "recent", start.Add(2*time.Hour+6*time.Minute)); l == nil {
+		t.Error("Pruning forgot a failure within the window")
+	}
+}
+
+func TestGuardClear(t *testing.T) {
+	g := newPublishGuard(2, 10*time.Minute, time.Minute, time.Hour)
+	now := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	g.fail(lockoutStream, "studio", now)
+	if g.clear(lockoutStream, "studio", now) {
+		t.Error("Cleared a stream which wasn't locked out")
+	}
+	g.fail(lockoutStream, "studio", now)
+	g.fail(lockoutStream, "studio", now.Add(time.Minute))
+	if l := g.fail(lockoutStream, "studio", now.Add(time.Minute)); l == nil || l.Lockouts != 2 {
+		t.Fatalf("Second lockout is %+v", l)
+	}
+
+	if !g.clear(lockoutStream, "studio", now.Add(time.Minute)) {
+		t.Fatal("Didn't clear a lockout")
+	}
+	if _, locked := g.lockedUntil(lockoutStream, "studio", now.Add(time.Minute)); locked {
+		t.Error("Still locked out once cleared")
+	}
+	// Clearing forgets both the failures and the backoff
+	if l := g.fail(lockoutStream, "studio", now.Add(time.Minute)); l != nil {
+		t.Error("Failures from before clearing still counted")
+	}
+	l := g.fail(lockoutStream, "studio", now.Add(time.Minute))
+	if l == nil || l.Lockouts != 1 || l.LockedUntil.Sub(now.Add(time.Minute)) != time.Minute {
+		t.Errorf("Lockout after clearing is %+v", l)
+	}
+}
+
+// publish makes an on_publish request, returning the status code
+func publish(e *env, name, key, addr string) int {
+	form := url.Values{"name": {name}, "key": {key}, "addr": {addr}}
+	r := httptest.NewRequest("POST", "/v1/rpc/publish", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serve(e, rpcHandleStreamHandler, r).Code
+}
+
+func TestPublishLockout(t *testing.T) {
+	e, cleanup := newTestEnv(t)
+	defer cleanup()
+	e.guard = newPublishGuard(3, 10*time.Minute, time.Minute, time.Hour)
+
+	w := serve(e, createStreamHandler, httptest.NewRequest("POST", "/v1/api/streams",
+		bytes.NewReader([]byte(`{"stream_name": "studio", "display_name": "Studio"}`))))
+	var created streamWithKey
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	// Guessing keys from many addresses locks out the stream name
+	for i := 1; i <= 3; i++ {
+		addr := "192.0.2." + strconv.Itoa(i)
+		if code := publish(e, "studio", "guess", addr); i < 3 && code != http.StatusUnauthorized || i == 3 && code != http.StatusTooManyRequests {
+			t.Fatalf("Guess %d got %d", i, code)
+		}
+	}
+	if code := publish(e, "studio", "guess", "192.0.2.10"); code != http.StatusTooManyRequests {
+		t.Errorf("Wrong key for a locked out stream got %d, want 429", code)
+	}
+
+	// The real publisher isn't held up, and their success lifts the lockout
+	if code := publish(e, "studio", created.Key, "198.51.100.1"); code != http.StatusOK {
+		t.Errorf("Right key for a locked out stream got %d, want 200", code)
+	}
+	if code := publish(e, "studio", "guess", "192.0.2.11"); code != http.StatusUnauthorized {
+		t.Errorf("Wrong key after a successful publish got %d, want 401", code)
+	}
+
+	// A locked out address is turned away even with the right key
+	for i := 0; i < 3; i++ {
+		publish(e, "nonexistent"+strconv.Itoa(i), "guess", "203.0.113.1")
+	}
+	if code := publish(e, "studio", created.Key, "203.0.113.1"); code != http.StatusTooManyRequests {
+		t.Errorf("Right key from a locked out address got %d, want 429", code)
+	}
+}
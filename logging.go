@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Loggers for parts of the server whose level can be set separately. Anything
+// else logs through the standard logger, configured as the "default" component.
+var (
+	componentsMu sync.Mutex
+	components   = map[string]*log.Logger{"default": log.StandardLogger()}
+
+	accessLog     = componentLogger("access")
+	hubLog        = componentLogger("hub")
+	statsLog      = componentLogger("stats")
+	nodesLog      = componentLogger("nodes")
+	alertsLog     = componentLogger("alerts")
+	recordingsLog = componentLogger("recordings")
+	busLog        = componentLogger("bus")
+)
+
+// The log file, if logging to one, so it can be reopened on SIGHUP
+var logFile *rotatingFile
+
+// componentLogger returns a logger whose level can be set in the config by name
+func componentLogger(name string) *log.Logger {
+	componentsMu.Lock()
+	defer componentsMu.Unlock()
+	l := log.New()
+	components[name] = l
+	return l
+}
+
+// requestLog returns a log entry tagged with the ID of a request
+func requestLog(r *http.Request) *log.Entry {
+	return log.WithField("request_id", requestID(r))
+}
+
+// configureLogging applies the [log] section of the config to every logger
+func configureLogging(conf *config, verbose bool) error {
+	var formatter log.Formatter
+	switch conf.Log.Format {
+	case "", "text":
+		formatter = &log.TextFormatter{}
+	case "json":
+		formatter = &log.JSONFormatter{TimestampFormat: time.RFC3339Nano}
+	default:
+		return errors.New("Log format must be text or json")
+	}
+
+	var out io.Writer
+	var hook log.Hook
+	switch conf.Log.Output {
+	case "", "stderr":
+		out = os.Stderr
+	case "file":
+		f, err := openRotatingFile(conf.Log.File, conf.Log.MaxSize, conf.Log.MaxBackups)
+		if err != nil {
+			return err
+		}
+		logFile, out = f, f
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "nexus-server")
+		if err != nil {
+			return err
+		}
+		out, hook = nopWriter{}, &syslogHook{w}
+	default:
+		return errors.New("Log output must be stderr, file or syslog")
+	}
+
+	defaultLevel := log.InfoLevel
+	if l, ok := conf.Log.Levels["default"]; ok {
+		var err error
+		if defaultLevel, err = log.ParseLevel(l); err != nil {
+			return err
+		}
+	}
+	if verbose || conf.Log.Verbose {
+		defaultLevel = log.DebugLevel
+	}
+
+	componentsMu.Lock()
+	defer componentsMu.Unlock()
+	for name := range conf.Log.Levels {
+		if _, ok := components[name]; !ok {
+			return fmt.Errorf("Unknown log component %s. Known components are %s", name, componentNames())
+		}
+	}
+	for name, l := range components {
+		l.Formatter, l.Out, l.Level = formatter, out, defaultLevel
+		if hook != nil {
+			l.Hooks.Add(hook)
+		}
+		if level, ok := conf.Log.Levels[name]; ok {
+			lvl, err := log.ParseLevel(level)
+			if err != nil {
+				return err
+			}
+			l.Level = lvl
+		}
+	}
+	return nil
+}
+
+func componentNames() []string {
+	names := make([]string, 0, len(components))
+	for name := range components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// reopenLogs reopens the log file, after it has been moved by logrotate
+func reopenLogs() {
+	if logFile == nil {
+		return
+	}
+	if err := logFile.reopen(); err != nil {
+		log.Errorf("Error reopening log file: %s", err.Error())
+	}
+}
+
+// rotatingFile is a log file which is rotated once it reaches a size, keeping
+// a number of old files as file.1, file.2 and so on
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if path == "" {
+		return nil, errors.New("No log file given")
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error rotating log file: %s\n", err.Error())
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups along, dropping the oldest, and starts a new file
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if r.maxBackups > 0 {
+		for i := r.maxBackups - 1; i > 0; i-- {
+			os.Rename(r.path+"."+strconv.Itoa(i), r.path+"."+strconv.Itoa(i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.f.Close()
+	return r.open()
+}
+
+type nopWriter struct{}
+
+func (nopWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+// syslogHook sends log entries to syslog, at the matching priority
+type syslogHook struct {
+	w *syslog.Writer
+}
+
+func (h *syslogHook) Levels() []log.Level {
+	return []log.Level{
+		log.PanicLevel, log.FatalLevel, log.ErrorLevel,
+		log.WarnLevel, log.InfoLevel, log.DebugLevel,
+	}
+}
+
+func (h *syslogHook) Fire(entry *log.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+	switch entry.Level {
+	case log.PanicLevel, log.FatalLevel:
+		return h.w.Crit(line)
+	case log.ErrorLevel:
+		return h.w.Err(line)
+	case log.WarnLevel:
+		return h.w.Warning(line)
+	case log.InfoLevel:
+		return h.w.Info(line)
+	default:
+		return h.w.Debug(line)
+	}
+}
+
+// accessRecorder notes the status and size of a response, for the access log
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (a *accessRecorder) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *accessRecorder) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(b)
+	a.bytes += int64(n)
+	return n, err
+}
+
+// Hijack lets websocket connections be upgraded through the recorder
+func (a *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := a.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Response can't be hijacked")
+	}
+	a.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// accessLogMiddleware logs every request once it has been handled, with its
+// status, size, duration and the authenticated actor, if any
+func accessLogMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		accessLog.WithFields(log.Fields{
+			"request_id":  requestID(r),
+			"remote_addr": r.RemoteAddr,
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      rec.status,
+			"bytes":       rec.bytes,
+			"duration_ms": float64(time.Since(start).Nanoseconds()) / 1e6,
+			"actor":       actorFromRequest(r),
+		}).Infof("%s %s %d", r.Method, r.URL.Path, rec.status)
+	})
+}
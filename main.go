@@ -8,11 +8,14 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/BurntSushi/toml"
-	"github.com/gorilla/handlers"
+	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
 	"github.com/justinas/alice"
@@ -22,24 +25,16 @@ import (
 	"github.com/mattes/migrate/migrate/direction"
 	"github.com/mattes/migrate/pipe"
 
-	_ "github.com/mattes/migrate/driver/ql"
 	_ "github.com/cznic/ql"
+	_ "github.com/mattes/migrate/driver/ql"
 
 	log "github.com/sirupsen/logrus"
-
 )
 
 const DBFILENAME = "data.db"
 
 var VERSION = "" // Should be automatically inserted by linker during build
 
-func logRequestMiddleware(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Infof("Request: %s %s", r.Method, r.URL.String())
-		h.ServeHTTP(w, r)
-	})
-}
-
 type appError interface {
 	error
 	Status() int
@@ -59,8 +54,18 @@ func (e statusError) Status() int {
 }
 
 type env struct {
+	conf                            *config
 	db                              *sqlx.DB
 	updatesWSHub, streamStatusWSHub *Hub
+	nodes                           *nodeRegistry
+	live                            *liveRegistry
+	ingest                          *ingestAssigner
+	alerts                          *alertEngine
+	guard                           *publishGuard
+	keys                            *keyGenerator
+	lifecycle                       *lifecycle
+	bus                             *bus
+	recordingDirs                   []string // Resolved from the config, to compare recording paths with
 }
 
 type appHandler struct {
@@ -71,61 +76,50 @@ type appHandler struct {
 func (ah appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	err := ah.H(ah.env, w, r)
 	if err != nil {
-		log.Println(err.Error())
 		writeError(w, r, err)
 	}
 }
 
-func writeError(w http.ResponseWriter, _ *http.Request, err error) {
-	var errStatus int
-	var errMessage string
-
-	switch e := err.(type) {
-	case appError:
-		errStatus, errMessage = e.Status(), e.Error()
-	default:
-		errStatus, errMessage = http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
-	}
-	if true { // TODO: replace with content-type detections
-		w.WriteHeader(errStatus)
-		enc := json.NewEncoder(w)
-		err := enc.Encode(struct {
-			Error string `json:"error"`
-		}{
-			errMessage,
-		})
-		if err == nil {
-			return // encoded error as json, so we're done
+const streamSQL = `
+	SELECT
+		id() as id, display_name, is_public, start_at, end_at, stream_name, key, rrule, timezone, resources,
+		description, tags, category, poster_url, links, channel_id, state, state_since
+	FROM
+		streams
+`
+
+// streamByID fetches a single stream, given the id from a request URL
+func (e *env) streamByID(r *http.Request, id string) (stream, error) {
+	var s stream
+	intID, err := strconv.Atoi(id)
+	if err != nil {
+		return s, statusError{
+			400,
+			errors.New("Non-numeric ID in URL"),
 		}
-		// Otherwise, drop through and fall back to text response
-		log.Warnf("Unable to encode error JSON! %s", err.Error())
 	}
-
-	http.Error(w, errMessage, errStatus)
+	err = e.db.Get(&s, streamSQL+`WHERE id()=$1`, int64(intID))
+	if err == sql.ErrNoRows {
+		return s, statusError{
+			404,
+			err,
+		}
+	} else if err != nil {
+		requestLog(r).Errorf("Error querying for stream: %s", err.Error())
+		return s, err
+	}
+	return s, nil
 }
 
-// Returns specific stream id if mux var exists, else returns all
+// Returns specific stream id if mux var exists, else returns all, optionally filtered by "tag" and
+// "category" query parameters
 func getStreamHandler(e *env, w http.ResponseWriter, r *http.Request) error {
-	const streamSQL = `
-		SELECT
-			id() as id, display_name, is_public, start_at, end_at, stream_name, key
-		FROM
-			streams
-	`
-
 	var err error
 	vars := mux.Vars(r)
 
 	if id, ok := vars["id"]; ok { // Specific id
-		var s stream
-		err := e.db.Get(&s, streamSQL+`WHERE id()=$1`, id)
-		if err == sql.ErrNoRows {
-			return statusError{
-				404,
-				err,
-			}
-		} else if err != nil {
-			log.Errorf("Error querying for stream: %s", err.Error())
+		s, err := e.streamByID(r, id)
+		if err != nil {
 			return err
 		}
 		err = json.NewEncoder(w).Encode(&s)
@@ -133,14 +127,14 @@ func getStreamHandler(e *env, w http.ResponseWriter, r *http.Request) error {
 		streams := make([]stream, 0)
 		err := e.db.Select(&streams, streamSQL)
 		if err != nil {
-			log.Errorf("Error querying for stream(s): %s", err.Error())
+			requestLog(r).Errorf("Error querying for stream(s): %s", err.Error())
 			return err
 		}
-		err = json.NewEncoder(w).Encode(streams)
+		err = json.NewEncoder(w).Encode(filterStreams(r, streams))
 	}
 
 	if err != nil {
-		log.Errorf("Error encoding json: %s", err.Error())
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
 		return err
 	}
 	return nil
@@ -171,6 +165,12 @@ func deleteStreamHandler(e *env, w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 	result, err := tx.Exec(deleteSQL, int64(intID))
+	for _, table := range []string{"stream_transitions", "stream_exceptions", "ingest_assignments", "recordings"} {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(`DELETE FROM `+table+` WHERE stream_id = $1`, int64(intID))
+	}
 	if err != nil {
 		if err := tx.Rollback(); err != nil {
 			return err
@@ -184,54 +184,96 @@ func deleteStreamHandler(e *env, w http.ResponseWriter, r *http.Request) error {
 
 	n, err := result.RowsAffected()
 	if err != nil {
-		log.Warnf("Unable to get number of rows affected: %s", err)
+		requestLog(r).Warnf("Unable to get number of rows affected: %s", err)
 		return nil // Delete still happened though, so don't error
 	}
 
 	if n == 0 {
-		http.Error(w, "Not found", http.StatusNotFound)
+		return statusError{
+			http.StatusNotFound,
+			errors.New("Stream not found"),
+		}
+	} else if e.conf.Posters.Dir != "" {
+		if err := os.Remove(e.posterFile(intID)); err != nil && !os.IsNotExist(err) {
+			requestLog(r).Warnf("Unable to remove poster of deleted stream: %s", err)
+		}
 	}
 
 	return nil
 }
 
 func createStreamHandler(e *env, w http.ResponseWriter, r *http.Request) error {
-	tx, err := e.db.Begin()
-	if err != nil {
+	var s stream
+	if err := decodeBody(w, r, &s); err != nil {
 		return err
 	}
 
-	var s stream
-
-	dec := json.NewDecoder(r.Body)
-
-	err = dec.Decode(&s)
-	if err != nil {
-		log.Debugf("Error decoding JSON: %s", err.Error())
+	if err := s.validateSchedule(); err != nil {
 		return statusError{
 			400,
 			err,
 		}
 	}
-
-	if s.Key != "" { // Client not allowed to specify key
-
+	if err := s.validateResources(); err != nil {
 		return statusError{
 			400,
-			errors.New("Client-specified key not allowed"),
+			err,
 		}
 	}
+	if err := s.validateMetadata(); err != nil {
+		return statusError{
+			400,
+			err,
+		}
+	}
+	s.ID = 0 // Read only, so ignore any given. Not yet stored, so can't clash with itself
+	if err := e.checkStreamChannel(&s); err != nil {
+		return err
+	}
+	if err := e.checkConflicts(s); err != nil {
+		return err
+	}
 
-	s.Key = randomString(20)
+	key, hash, err := e.newStreamKey(r)
+	if err != nil {
+		return err
+	}
+	s.KeyHash = hash
 
+	// New streams start as drafts, or scheduled if they have an upcoming occurrence
+	now := time.Now()
+	s.State, s.StateSince = stateDraft, toNullTime(now)
+	if s.State, err = e.scheduledState(&s, now); err != nil {
+		return err
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
 	result, err := tx.Exec(`
 		INSERT INTO streams (
-			display_name, is_public, start_at, end_at, stream_name, key
+			display_name, is_public, start_at, end_at, stream_name, key, rrule, timezone, resources,
+			description, tags, category, poster_url, links, channel_id, state, state_since
 		) VALUES (
-			$1, $2, $3, $4, $5, $6
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17
 		)`,
-		s.DisplayName, s.IsPublic, s.StartAt, s.EndAt, s.StreamName, s.Key,
+		s.DisplayName, s.IsPublic, s.StartAt, s.EndAt, s.StreamName, s.KeyHash, s.RRule, s.Timezone, s.Resources,
+		s.Description, s.Tags, s.Category, s.PosterURL, s.Links, int64(s.ChannelID), string(s.State), s.StateSince,
 	)
+	if err == nil {
+		var id int64
+		if id, err = result.LastInsertId(); err == nil {
+			_, err = tx.Exec(`
+				INSERT INTO stream_transitions (
+					stream_id, from_state, to_state, reason, at
+				) VALUES (
+					$1, "", $2, "created", $3
+				)`,
+				id, string(s.State), now,
+			)
+		}
+	}
 	if err != nil {
 		rerr := tx.Rollback()
 		if rerr != nil {
@@ -242,59 +284,91 @@ func createStreamHandler(e *env, w http.ResponseWriter, r *http.Request) error {
 	}
 	cerr := tx.Commit()
 	if cerr != nil {
-		log.Errorf("Error comitting transaction: %s", err.Error())
-		return err
+		requestLog(r).Errorf("Error committing transaction: %s", cerr.Error())
+		return cerr
 	}
 
 	id, err := result.LastInsertId()
 	if err != nil {
-		log.Errorf("Error retrieving ID of inserted row: %s", err.Error())
+		requestLog(r).Errorf("Error retrieving ID of inserted row: %s", err.Error())
 		return nil // Todo: maybe not return 200 here.
 	}
 
 	s.ID = int(id)
 
-	err = json.NewEncoder(w).Encode(&s)
+	// The only time the key is shown, unless it is rotated
+	w.Header().Set("Cache-Control", "no-store")
+	err = json.NewEncoder(w).Encode(&streamWithKey{s, key})
 	if err != nil {
-		log.Errorf("Error encoding json: %s" + err.Error())
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
 	}
 
 	return nil
 }
 
 // Handle requests originating from nginx-rtmp's on_publish feature. Validate a stream's name and key
-// against the database.
+// against the database. Each ingest node should identify itself by adding a "node" query parameter
+// to its on_publish URL, so publishes to the wrong node can be rejected or redirected.
 func rpcHandleStreamHandler(e *env, w http.ResponseWriter, r *http.Request) error {
 	var s stream
-	if r.FormValue("name") == "" {
+	name, addr := r.FormValue("name"), r.FormValue("addr") // addr is the publisher's IP address
+	if name == "" {
 		return statusError{
 			400,
 			errors.New("No stream name"),
 		}
 	}
-	err := e.db.Get(&s, "SELECT * FROM streams WHERE stream_name = $1", r.FormValue("name"))
+	// A locked out stream name is only checked once the key is known to be
+	// wrong, so the right key still works
+	if !e.checkLockout(w, name, addr, lockoutAddr) {
+		return nil
+	}
+	err := e.db.Get(&s, streamSQL+"WHERE stream_name = $1", name)
 	if err == sql.ErrNoRows {
-		w.WriteHeader(http.StatusUnauthorized)
+		e.rejectPublish(w, name, addr, "unknown_stream")
 		return nil
 	} else if err != nil {
 		return err
 	}
-	if s.Key != r.FormValue("key") { // The key passed in the stream URL
-		w.WriteHeader(http.StatusUnauthorized)
+	if !keyMatches(s.KeyHash, r.FormValue("key")) { // The key passed in the stream URL
+		e.rejectPublish(w, name, addr, "bad_key")
+		return nil
+	}
+	e.publishSucceeded(name, addr)
+	if s.State == stateArchived {
+		requestLog(r).Infof("Rejected publish of archived stream %s", name)
+		w.WriteHeader(http.StatusForbidden)
 		return nil
 	}
+	if ok, err := e.checkPublishWindow(w, s); !ok || err != nil {
+		return err
+	}
+	if ok, err := e.checkPublishNode(w, r, s, r.FormValue("node")); !ok || err != nil {
+		return err
+	}
+	e.deriveState(name, stateStarting, "publish from "+addr, stateDraft, stateScheduled, stateEnded)
 	return nil
 }
 
 func updatesHandler(e *env, w http.ResponseWriter, r *http.Request) error {
-	if err := e.updatesWSHub.handleRequest(w, r); err != nil {
+	if err := e.updatesWSHub.handleRequest(w, r, ""); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Only ingest nodes may report stream status, authenticated by a node token or
+// client certificate
 func streamStatusHandler(e *env, w http.ResponseWriter, r *http.Request) error {
-	if err := e.streamStatusWSHub.handleRequest(w, r); err != nil {
+	node, err := e.authenticateNode(r)
+	if err != nil {
+		if _, ok := err.(statusError); ok {
+			requestLog(r).Warnf("Rejected streamstatus websocket from %s: %s", r.RemoteAddr, err.Error())
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nexus-server"`)
+		}
+		return err
+	}
+	if err := e.streamStatusWSHub.handleRequest(w, r, node); err != nil {
 		return err
 	}
 	return nil
@@ -303,9 +377,9 @@ func streamStatusHandler(e *env, w http.ResponseWriter, r *http.Request) error {
 func runMigrations(dbURL, migrationsPath string) {
 	log.Info("Applying migrations")
 	pipe := pipe.New()
-	go migrate.Up(pipe, "ql+" + dbURL, migrationsPath)
+	go migrate.Up(pipe, "ql+"+dbURL, migrationsPath)
 	ok := true
-	OuterLoop:
+OuterLoop:
 	for {
 		select {
 		case item, more := <-pipe:
@@ -317,7 +391,7 @@ func runMigrations(dbURL, migrationsPath string) {
 				log.Errorf("Error migrating: %s", item.(error).Error())
 				ok = false
 			case file.File:
-				f:= item.(file.File)
+				f := item.(file.File)
 				var dir string
 				if f.Direction == direction.Up {
 					dir = "up"
@@ -334,22 +408,221 @@ func runMigrations(dbURL, migrationsPath string) {
 
 }
 
+// Values given to existing rows by columns added in migrations. ql panics if a
+// table with constraints is updated in the same session as it was altered, so
+// rather than by the migrations, the rows are filled in once the database has
+// been reopened.
+var columnDefaults = []struct {
+	table, column, value string
+}{
+	{"nodes", "control_url", `""`},
+	{"nodes", "stat_url", `""`},
+	{"nodes", "token_hash", `""`},
+	{"streams", "rrule", `""`},
+	{"streams", "timezone", `""`},
+	{"streams", "resources", `""`},
+	{"streams", "description", `""`},
+	{"streams", "tags", `""`},
+	{"streams", "category", `""`},
+	{"streams", "poster_url", `""`},
+	{"streams", "links", `""`},
+	{"streams", "channel_id", "0"},
+	{"streams", "state", `"draft"`},
+	{"streams", "state_since", "now()"},
+}
+
+// fillNewColumns sets columns left null by migrations to their defaults
+func fillNewColumns(db *sqlx.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, c := range columnDefaults {
+		_, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET %s = %s WHERE %s IS NULL`, c.table, c.column, c.value, c.column))
+		if err != nil {
+			if rerr := tx.Rollback(); rerr != nil {
+				return rerr
+			}
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 type config struct {
 	Log struct {
-		Verbose bool // Make more logging noise
+		Verbose    bool              // Make more logging noise. Same as a default level of debug
+		Format     string            // text or json
+		Output     string            // stderr, file or syslog
+		File       string            // Where to log, if output is file
+		MaxSize    int64             // Rotate the log file once it reaches this many bytes. Zero never rotates
+		MaxBackups int               // How many rotated log files to keep
+		Levels     map[string]string // Level of each component, such as access or hub. "default" sets the rest
+	}
+	HTTP struct {
+		CORS struct {
+			Public corsConfig // Public API, calendar and updates websocket
+			Admin  corsConfig // Authenticated API
+		}
+	}
+	Events struct {
+		Buffer int // Events queued for each subscriber before more are dropped
+	}
+	Hubs struct {
+		Updates      hubConfig // Updates websocket. Defaults to coalesce
+		StreamStatus hubConfig // Node status websocket. Defaults to disconnect
 	}
-	API struct {
-		Listen string // Listen address of HTTP API server
+	API       listenerConfig // Serves the routes of any listener below without its own address
+	Listeners struct {
+		Public listenerConfig // Viewer API, calendar and updates websocket
+		Admin  listenerConfig // Authenticated API
+		RPC    listenerConfig // nginx-rtmp callbacks and the node status websocket
 	}
 	Data struct {
 		MigrationsDir string
-		Dir string // Path to directory to store db
+		Dir           string // Path to directory to store db
+	}
+	Nodes struct {
+		HeartbeatTimeout duration // Mark an ingest node offline after this long without a heartbeat
+	}
+	Ingest struct {
+		Policies []string // Chain of policies used to choose an ingest node for a stream
+		Region   string   // Preferred region, if the request doesn't specify one
+		Enforce  string   // What to do when a stream is published to the wrong node: off, reject or redirect
+	}
+	Schedule struct {
+		EnforceWindow bool     // Only allow streams with a schedule to be published during an occurrence
+		LeadTime      duration // How long before an occurrence publishing may start
+		Overrun       duration // How long after an occurrence ends publishing may continue
+		Exclusive     []string // Kinds of resource which only one stream may use at a time
+		Horizon       duration // How far ahead to look for conflicts between recurring streams
+	}
+	Stats struct {
+		Interval duration // How often to poll the stat module of each ingest node
+	}
+	Recordings struct {
+		Dirs        []string // Directories nginx-rtmp records to. Only files in these can be downloaded
+		Retention   duration // Prune recordings older than this. Zero keeps them forever
+		DeleteFiles bool     // Delete the files of pruned recordings too
+	}
+	Public struct {
+		MaxAge duration // How long clients and proxies may cache public API responses
+	}
+	Posters struct {
+		Dir     string // Where uploaded poster images are stored. Uploads are disabled if empty
+		MaxSize int64  // Largest poster upload accepted, in bytes
+	}
+	Lockout struct {
+		MaxFailures int      // Failed publish attempts from an address, or for a stream name, before it is locked out. Negative disables lockouts
+		Window      duration // Period failed attempts are counted over
+		Duration    duration // Length of the first lockout. Each consecutive lockout is twice as long
+		MaxDuration duration // Longest a lockout may last
+	}
+	Alerts struct {
+		Interval  duration              // How often to evaluate alert rules
+		Rules     []alertRule           // Rules in addition to those created through the API
+		Notifiers []alertNotifierConfig // Where to deliver fired and resolved alerts
+	}
+	Calendar struct {
+		Name   string // Shown by calendar apps subscribed to the feed
+		Domain string // Used to make event UIDs unique. Defaults to the hostname
+		Token  string // Allows the feed to include private streams
+	}
+	Keys struct {
+		Length   int    // Random characters in a stream key, after the prefix
+		Alphabet string // Characters a stream key is made of
+		Prefix   string // Starts every stream key, so leaked keys are easy to spot
+	}
+	Auth struct {
+		Tokens []authToken // Bearer tokens allowed to use authenticated endpoints
 	}
 }
 
+// publicRoutes are read-only and cacheable, for anyone
+func (e *env) publicRoutes(router *mux.Router) {
+	router.Handle("/v1/ws/updates", appHandler{e, updatesHandler})
+	router.Handle("/v1/openapi.json", appHandler{e, openAPIHandler}).Methods("GET")
+	router.Handle("/v1/calendar.ics", appHandler{e, calendarHandler}).Methods("GET")
+
+	publicRouter := router.PathPrefix("/v1/public/").Subrouter()
+	publicRouter.Handle("/streams", appHandler{e, publicStreamsHandler}).Methods("GET")
+	publicRouter.Handle("/streams/search", appHandler{e, publicSearchHandler}).Methods("GET")
+	publicRouter.Handle("/streams/{id}", appHandler{e, publicStreamHandler}).Methods("GET")
+	publicRouter.Handle("/streams/{id}/occurrences", appHandler{e, publicOccurrencesHandler}).Methods("GET")
+	publicRouter.Handle("/streams/{id}/poster", appHandler{e, publicPosterHandler}).Methods("GET")
+	publicRouter.Handle("/channels", appHandler{e, publicChannelsHandler}).Methods("GET")
+	publicRouter.Handle("/channels/{id}", appHandler{e, publicChannelHandler}).Methods("GET")
+	publicRouter.Handle("/channels/{id}/now", appHandler{e, publicChannelNowHandler}).Methods("GET")
+	publicRouter.Handle("/channels/{id}/next", appHandler{e, publicChannelNextHandler}).Methods("GET")
+}
+
+// adminRoutes give the full admin view, and are authenticated
+func (e *env) adminRoutes(router *mux.Router) {
+	router.Handle("/v1/ws/updates", appHandler{e, updatesHandler})
+	router.Handle("/v1/openapi.json", appHandler{e, openAPIHandler}).Methods("GET")
+
+	apiRouter := router.PathPrefix("/v1/api/").Subrouter()
+	apiRouter.Handle("/streams", appHandler{e, requireAuth(getStreamHandler)}).Methods("GET")
+	apiRouter.Handle("/streams/search", appHandler{e, requireAuth(searchStreamsHandler)}).Methods("GET")
+	apiRouter.Handle("/streams/{id}", appHandler{e, requireAuth(getStreamHandler)}).Methods("GET")
+	apiRouter.Handle("/streams/{id}", appHandler{e, requireAuth(updateStreamHandler)}).Methods("PUT")
+	apiRouter.Handle("/streams/{id}", appHandler{e, requireAuth(deleteStreamHandler)}).Methods("DELETE")
+	apiRouter.Handle("/streams", appHandler{e, requireAuth(createStreamHandler)}).Methods("POST")
+	apiRouter.Handle("/streams/{id}/poster", appHandler{e, requireAuth(getPosterHandler)}).Methods("GET")
+	apiRouter.Handle("/streams/{id}/poster", appHandler{e, requireAuth(uploadPosterHandler)}).Methods("PUT")
+	apiRouter.Handle("/streams/{id}/key/rotate", appHandler{e, requireAuth(rotateKeyHandler)}).Methods("POST")
+	apiRouter.Handle("/streams/{id}/state", appHandler{e, requireAuth(setStreamStateHandler)}).Methods("PUT")
+	apiRouter.Handle("/streams/{id}/transitions", appHandler{e, requireAuth(getTransitionsHandler)}).Methods("GET")
+	apiRouter.Handle("/streams/{id}/ingest", appHandler{e, requireAuth(getIngestHandler)}).Methods("GET")
+	apiRouter.Handle("/streams/{id}/occurrences", appHandler{e, requireAuth(getOccurrencesHandler)}).Methods("GET")
+	apiRouter.Handle("/streams/{id}/exceptions", appHandler{e, requireAuth(getExceptionsHandler)}).Methods("GET")
+	apiRouter.Handle("/streams/{id}/exceptions", appHandler{e, requireAuth(createExceptionHandler)}).Methods("POST")
+	apiRouter.Handle("/streams/{id}/exceptions/{exid}", appHandler{e, requireAuth(deleteExceptionHandler)}).Methods("DELETE")
+	apiRouter.Handle("/schedule/conflicts", appHandler{e, requireAuth(getConflictsHandler)}).Methods("GET")
+	apiRouter.Handle("/streams/{id}/recordings", appHandler{e, requireAuth(getStreamRecordingsHandler)}).Methods("GET")
+	apiRouter.Handle("/recordings/{id}/download", appHandler{e, requireAuth(downloadRecordingHandler)}).Methods("GET")
+	apiRouter.Handle("/streams/{id}/drop", appHandler{e, requireAuth(dropPublisherHandler)}).Methods("POST")
+	apiRouter.Handle("/streams/{id}/clients/{clientid}/drop", appHandler{e, requireAuth(dropClientHandler)}).Methods("POST")
+	apiRouter.Handle("/channels", appHandler{e, requireAuth(getChannelsHandler)}).Methods("GET")
+	apiRouter.Handle("/channels", appHandler{e, requireAuth(createChannelHandler)}).Methods("POST")
+	apiRouter.Handle("/channels/{id}", appHandler{e, requireAuth(getChannelHandler)}).Methods("GET")
+	apiRouter.Handle("/channels/{id}", appHandler{e, requireAuth(updateChannelHandler)}).Methods("PUT")
+	apiRouter.Handle("/channels/{id}", appHandler{e, requireAuth(deleteChannelHandler)}).Methods("DELETE")
+	apiRouter.Handle("/channels/{id}/streams", appHandler{e, requireAuth(getChannelStreamsHandler)}).Methods("GET")
+	apiRouter.Handle("/channels/{id}/now", appHandler{e, requireAuth(getChannelNowHandler)}).Methods("GET")
+	apiRouter.Handle("/channels/{id}/next", appHandler{e, requireAuth(getChannelNextHandler)}).Methods("GET")
+	apiRouter.Handle("/live", appHandler{e, requireAuth(getLiveHandler)}).Methods("GET")
+	apiRouter.Handle("/nodes", appHandler{e, requireAuth(getNodesHandler)}).Methods("GET")
+	apiRouter.Handle("/nodes", appHandler{e, requireAuth(registerNodeHandler)}).Methods("POST")
+	apiRouter.Handle("/nodes/{name}", appHandler{e, requireAuth(deleteNodeHandler)}).Methods("DELETE")
+	apiRouter.Handle("/nodes/{name}/token/rotate", appHandler{e, requireAuth(rotateNodeTokenHandler)}).Methods("POST")
+
+	apiRouter.Handle("/alerts", appHandler{e, requireAuth(getAlertsHandler)}).Methods("GET")
+	apiRouter.Handle("/alerts/rules", appHandler{e, requireAuth(getAlertRulesHandler)}).Methods("GET")
+	apiRouter.Handle("/alerts/rules", appHandler{e, requireAuth(createAlertRuleHandler)}).Methods("POST")
+	apiRouter.Handle("/alerts/rules/{id}", appHandler{e, requireAuth(deleteAlertRuleHandler)}).Methods("DELETE")
+	apiRouter.Handle("/audit", appHandler{e, requireAuth(getAuditLogHandler)}).Methods("GET")
+	apiRouter.Handle("/lockouts", appHandler{e, requireAuth(getLockoutsHandler)}).Methods("GET")
+	apiRouter.Handle("/lockouts", appHandler{e, requireAuth(clearLockoutsHandler)}).Methods("DELETE")
+	apiRouter.Handle("/lockouts/{scope}/{key}", appHandler{e, requireAuth(clearLockoutHandler)}).Methods("DELETE")
+	apiRouter.Handle("/hubs", appHandler{e, requireAuth(getHubsHandler)}).Methods("GET")
+	apiRouter.Handle("/metrics", appHandler{e, requireAuth(metricsHandler)}).Methods("GET")
+}
+
+// rpcRoutes are for ingest nodes: nginx-rtmp's callbacks, and the websocket
+// nodes report their status over
+func (e *env) rpcRoutes(router *mux.Router) {
+	router.Handle("/v1/ws/streamstatus", appHandler{e, streamStatusHandler})
+
+	rpcRouter := router.PathPrefix("/v1/rpc/").Subrouter()
+	rpcRouter.Handle("/handle_stream", appHandler{e, rpcHandleStreamHandler})
+	rpcRouter.Handle("/play", appHandler{e, rpcPlayHandler})
+	rpcRouter.Handle("/record_done", appHandler{e, rpcRecordDoneHandler})
+}
+
 func main() {
 	// Flags
-	var configFile = *flag.String("config", "config.toml", "Path to config file")
+	var configFile = flag.String("config", "config.toml", "Path to config file")
 	var verbose = flag.Bool("verbose", false, "Show debug messages")
 	var version = flag.Bool("version", false, "Show version")
 	flag.Parse()
@@ -361,19 +634,22 @@ func main() {
 
 	// Parse config
 	var conf config
-	if _, err := toml.DecodeFile(configFile, &conf); err != nil {
+	if _, err := toml.DecodeFile(*configFile, &conf); err != nil {
 		log.Fatalf("Error reading config file: %s", err.Error())
 	}
 
-	if (*verbose == true) || conf.Log.Verbose {
-		log.SetLevel(log.DebugLevel)
-		log.Debug("Being verbose...")
+	if err := configureLogging(&conf, *verbose); err != nil {
+		log.Fatalf("Error configuring logging: %s", err.Error())
+	}
+	log.Debug("Being verbose...")
+	if err := loadOpenAPI(); err != nil {
+		log.Fatalf("Error building OpenAPI document: %s", err.Error())
 	}
 	if !path.IsAbs(conf.Data.Dir) {
 		log.Warnf("Using relative path to data directory: %s", conf.Data.Dir)
 	}
 
-	dbURL := "file://"+path.Join(conf.Data.Dir, DBFILENAME)
+	dbURL := "file://" + path.Join(conf.Data.Dir, DBFILENAME)
 
 	// Apply database migrations
 	runMigrations(dbURL, conf.Data.MigrationsDir)
@@ -382,46 +658,174 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error connecting to DB: %s", err.Error())
 	}
+	if err := fillNewColumns(db); err != nil {
+		log.Fatalf("Error filling in new columns: %s", err.Error())
+	}
+	if err := migrateStreamKeys(db); err != nil {
+		log.Fatalf("Error hashing stream keys: %s", err.Error())
+	}
+
+	keys, err := newKeyGenerator(conf.Keys.Length, conf.Keys.Alphabet, conf.Keys.Prefix)
+	if err != nil {
+		log.Fatalf("Error configuring stream keys: %s", err.Error())
+	}
+
+	live := newLiveRegistry()
+	ingest, err := newIngestAssigner(conf.Ingest.Policies, conf.Ingest.Region, conf.Ingest.Enforce, live)
+	if err != nil {
+		log.Fatalf("Error configuring ingest assignment: %s", err.Error())
+	}
+
+	for i := range conf.Alerts.Rules {
+		if err := conf.Alerts.Rules[i].validate(); err != nil {
+			log.Fatalf("Error in alert rules: %s", err.Error())
+		}
+	}
+	if conf.Hubs.Updates.Policy == "" {
+		conf.Hubs.Updates.Policy = hubPolicyCoalesce
+	}
+	if err := conf.Hubs.Updates.validate("updates"); err != nil {
+		log.Fatalf("Error configuring hubs: %s", err.Error())
+	}
+	if err := conf.Hubs.StreamStatus.validate("streamstatus"); err != nil {
+		log.Fatalf("Error configuring hubs: %s", err.Error())
+	}
+
+	notifiers, err := newNotifiers(conf.Alerts.Notifiers)
+	if err != nil {
+		log.Fatalf("Error configuring alert notifiers: %s", err.Error())
+	}
 
 	e := &env{
+		conf:              &conf,
 		db:                db,
-		updatesWSHub:      newHub(),
-		streamStatusWSHub: newHub(),
+		updatesWSHub:      newHub("updates", conf.Hubs.Updates, conf.HTTP.CORS.Public.checkOrigin),
+		streamStatusWSHub: newHub("streamstatus", conf.Hubs.StreamStatus, (&corsConfig{}).checkOrigin), // Nodes aren't browsers, so allow no other origins
+		nodes:             newNodeRegistry(conf.Nodes.HeartbeatTimeout.Duration),
+		live:              live,
+		ingest:            ingest,
+		alerts:            newAlertEngine(notifiers),
+		keys:              keys,
+		recordingDirs:     resolveRecordingDirs(conf.Recordings.Dirs),
+		lifecycle:         newLifecycle(),
+		bus:               newBus(conf.Events.Buffer),
+		guard: newPublishGuard(conf.Lockout.MaxFailures, conf.Lockout.Window.Duration,
+			conf.Lockout.Duration.Duration, conf.Lockout.MaxDuration.Duration),
+	}
+
+	if err := e.nodes.load(db); err != nil {
+		log.Fatalf("Error loading ingest nodes: %s", err.Error())
 	}
 
-	// For now, broadcast any stream status updates to all clients
-	e.streamStatusWSHub.setIncomingHandler(func(m *Message) {
-		log.Infof("Message from %s: %s", m.remoteAddr, string(m.data))
-		e.updatesWSHub.broadcast <- m.data
-	})
+	e.subscribe()
+	e.streamStatusWSHub.setIncomingHandler(e.handleStatusMessage)
 
 	go e.updatesWSHub.run()
 	go e.streamStatusWSHub.run()
+	go e.watchNodes()
+	go e.pruneRecordings()
+	go e.pollStats()
+	go e.runAlerts()
+	go e.pruneLockouts()
+	go e.runLifecycle()
 
 	commonHandlers := alice.New(
-		logRequestMiddleware,
-		handlers.CORS(
-			//handlers.AllowedOrigins([]string{"*"}),
-			handlers.AllowedMethods([]string{"GET", "POST", "DELETE", "OPTIONS"}),
-		),
+		context.ClearHandler,
+		requestIDMiddleware,
+		accessLogMiddleware,
+		corsMiddleware(conf.HTTP.CORS.Public, conf.HTTP.CORS.Admin),
 	)
 
-	router := mux.NewRouter()
-	router.Handle("/v1/ws/updates", appHandler{e, updatesHandler})
-	router.Handle("/v1/ws/streamstatus", appHandler{e, streamStatusHandler})
-
-	apiRouter := router.PathPrefix("/v1/api/").Subrouter()
-	apiRouter.Handle("/streams", appHandler{e, getStreamHandler}).Methods("GET")
-	apiRouter.Handle("/streams/{id}", appHandler{e, getStreamHandler}).Methods("GET")
-	apiRouter.Handle("/streams/{id}", appHandler{e, deleteStreamHandler}).Methods("DELETE")
-	apiRouter.Handle("/streams", appHandler{e, createStreamHandler}).Methods("POST")
+	// Each set of routes is served on its own listener if one is configured,
+	// and otherwise on the API listener
+	listeners := []struct {
+		name   string
+		conf   listenerConfig
+		routes func(*mux.Router)
+	}{
+		{"public", conf.Listeners.Public, e.publicRoutes},
+		{"admin", conf.Listeners.Admin, e.adminRoutes},
+		{"rpc", conf.Listeners.RPC, e.rpcRoutes},
+	}
+	var servers []*server
+	var unassigned []func(*mux.Router)
+	for _, l := range listeners {
+		if l.conf.Listen == "" {
+			unassigned = append(unassigned, l.routes)
+			continue
+		}
+		s, err := e.newServer(l.name, l.conf, commonHandlers, l.routes)
+		if err != nil {
+			log.Fatalf("Error configuring %s listener: %s", l.name, err.Error())
+		}
+		servers = append(servers, s)
+	}
+	if len(unassigned) > 0 {
+		s, err := e.newServer("api", conf.API, commonHandlers, unassigned...)
+		if err != nil {
+			log.Fatalf("Error configuring api listener: %s", err.Error())
+		}
+		servers = append(servers, s)
+	}
 
-	rpcRouter := router.PathPrefix("/v1/rpc/").Subrouter()
-	rpcRouter.Handle("/handle_stream", appHandler{e, rpcHandleStreamHandler})
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			sdNotify("RELOADING=1")
+			reloadTLS(servers)
+			reopenLogs()
+			sdNotify("READY=1")
+		}
+	}()
 
-	log.Infof("Listening on %s", conf.API.Listen)
-	err = http.ListenAndServe(conf.API.Listen, commonHandlers.Then(router))
+	// Sockets passed by systemd are matched to listeners by name. A single
+	// unnamed socket is used if there is only one listener.
+	activated, err := activatedListeners()
 	if err != nil {
+		log.Fatalf("Error using sockets passed by systemd: %s", err.Error())
+	}
+	if ln, ok := activated["unknown"]; ok && len(servers) == 1 {
+		delete(activated, "unknown")
+		activated[servers[0].name] = ln
+	}
+
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		ln, err := s.listen(activated)
+		if err != nil {
+			log.Fatalf("Error listening on %s: %s", s.conf.Listen, err.Error())
+		}
+		go func(s *server) {
+			errs <- s.serve(ln)
+		}(s)
+	}
+	for name, ln := range activated {
+		log.Warnf("Ignoring socket %s passed by systemd, which matches no listener", name)
+		ln.Close()
+	}
+
+	sdNotify("READY=1")
+	stopWatchdog := make(chan struct{})
+	if interval := watchdogInterval(); interval > 0 {
+		go e.keepAlive(interval, stopWatchdog)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
 		log.Fatalf("Error starting server: %s", err.Error())
+	case sig := <-stop:
+		log.Infof("Received %s, shutting down", sig)
+		sdNotify("STOPPING=1")
+		close(stopWatchdog) // The DB is about to be closed
+		shutdown(servers)
+		if !e.bus.close(5 * time.Second) {
+			log.Warn("Gave up waiting for events to be handled")
+		}
+		if err := db.Close(); err != nil {
+			log.Errorf("Error closing DB: %s", err.Error())
+		}
 	}
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+// newTestEnv returns an env with a freshly migrated database in a temporary
+// directory. The returned function removes it again.
+func newTestEnv(t *testing.T) (*env, func()) {
+	if err := loadOpenAPI(); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "nexus-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbURL := "file://" + path.Join(dir, DBFILENAME)
+	runMigrations(dbURL, "migrations")
+
+	db, err := sqlx.Connect("ql", dbURL)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	if err := fillNewColumns(db); err != nil {
+		db.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	keys, err := newKeyGenerator(0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conf config
+	live := newLiveRegistry()
+	ingest, err := newIngestAssigner(nil, "", "", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &env{
+		conf:      &conf,
+		db:        db,
+		nodes:     newNodeRegistry(0),
+		live:      live,
+		ingest:    ingest,
+		keys:      keys,
+		lifecycle: newLifecycle(),
+		bus:       newBus(0),
+		guard:     newPublishGuard(0, 0, 0, 0),
+	}
+	return e, func() {
+		e.bus.close(time.Second)
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// serve calls a handler with a request, as the router would
+func serve(e *env, h func(*env, http.ResponseWriter, *http.Request) error, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	appHandler{e, h}.ServeHTTP(w, r)
+	return w
+}
+
+// route calls a handler through a router, so it sees the variables in the
+// request's path
+func route(e *env, pattern string, h func(*env, http.ResponseWriter, *http.Request) error, r *http.Request) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.Handle(pattern, appHandler{e, h})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// createStream creates a stream from its JSON, failing the test if that fails
+func createStream(t *testing.T, e *env, body string) streamWithKey {
+	w := serve(e, createStreamHandler, httptest.NewRequest("POST", "/v1/api/streams", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Creating stream got %d: %s", w.Code, w.Body)
+	}
+	var created streamWithKey
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	return created
+}
+
+func TestCreateStreamResponse(t *testing.T) {
+	e, cleanup := newTestEnv(t)
+	defer cleanup()
+
+	body := []byte(`{
+		"stream_name": "studio",
+		"display_name": "Studio",
+		"start_at": "2030-01-01T18:00:00Z",
+		"end_at": "2030-01-01T19:00:00Z"
+	}`)
+	w := serve(e, createStreamHandler, httptest.NewRequest("POST", "/v1/api/streams", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status %d: %s", w.Code, w.Body)
+	}
+
+	var created map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	// Times must have the same shape as when a stream is fetched
+	for _, field := range []string{"start_at", "end_at", "state_since"} {
+		s, ok := created[field].(string)
+		if !ok {
+			t.Errorf("%s is %v, not an RFC 3339 string", field, created[field])
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, s); err != nil {
+			t.Errorf("%s: %s", field, err)
+		}
+	}
+	if created["start_at"] != "2030-01-01T18:00:00Z" {
+		t.Errorf("start_at is %v", created["start_at"])
+	}
+	if key, _ := created["key"].(string); key == "" {
+		t.Error("Created stream has no key")
+	}
+	if _, ok := created["key_hash"]; ok {
+		t.Error("Created stream includes its key hash")
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Cache-Control is %q, want no-store", cc)
+	}
+}
+
+func TestDeleteStreamRemovesRows(t *testing.T) {
+	e, cleanup := newTestEnv(t)
+	defer cleanup()
+
+	s := createStream(t, e, `{"stream_name": "studio", "display_name": "Studio", "start_at": "2030-01-01T18:00:00Z", "rrule": "FREQ=DAILY"}`)
+	kept := createStream(t, e, `{"stream_name": "other", "display_name": "Other"}`)
+	for _, id := range []int{s.ID, kept.ID} {
+		tx, err := e.db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range []string{
+			`INSERT INTO stream_exceptions (stream_id, occurrence, cancelled) VALUES ($1, $2, true)`,
+			`INSERT INTO ingest_assignments (stream_id, node, assigned_at) VALUES ($1, "ingest1", $2)`,
+			`INSERT INTO recordings (stream_id, stream_name, path, recorded_at) VALUES ($1, "studio", "/rec/studio.flv", $2)`,
+		} {
+			if _, err := tx.Exec(q, int64(id), time.Date(2030, 1, 2, 18, 0, 0, 0, time.UTC)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := route(e, "/v1/api/streams/{id}", deleteStreamHandler, httptest.NewRequest("DELETE", "/v1/api/streams/"+strconv.Itoa(s.ID), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Delete got %d: %s", w.Code, w.Body)
+	}
+	for _, table := range []string{"stream_transitions", "stream_exceptions", "ingest_assignments", "recordings"} {
+		var n int64
+		if err := e.db.Get(&n, `SELECT count(*) FROM `+table+` WHERE stream_id = $1`, int64(s.ID)); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("%d %s row(s) left for the deleted stream", n, table)
+		}
+		if err := e.db.Get(&n, `SELECT count(*) FROM `+table+` WHERE stream_id = $1`, int64(kept.ID)); err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 && table != "stream_transitions" {
+			t.Errorf("%s rows of another stream deleted", table)
+		}
+	}
+}
+
+func TestDuplicateStreamName(t *testing.T) {
+	e, cleanup := newTestEnv(t)
+	defer cleanup()
+
+	studio := createStream(t, e, `{"stream_name": "studio", "display_name": "Studio"}`)
+	other := createStream(t, e, `{"stream_name": "other", "display_name": "Other"}`)
+	w := serve(e, createChannelHandler, httptest.NewRequest("POST", "/v1/api/channels",
+		strings.NewReader(`{"name": "main", "playback_name": "main"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Creating channel got %d: %s", w.Code, w.Body)
+	}
+
+	update := func(id int, body string) *httptest.ResponseRecorder {
+		return route(e, "/v1/api/streams/{id}", updateStreamHandler,
+			httptest.NewRequest("PUT", "/v1/api/streams/"+strconv.Itoa(id), strings.NewReader(body)))
+	}
+	tests := []struct {
+		name string
+		do   func() *httptest.ResponseRecorder
+		msg  string
+	}{
+		{"Create", func() *httptest.ResponseRecorder {
+			return serve(e, createStreamHandler, httptest.NewRequest("POST", "/v1/api/streams",
+				strings.NewReader(`{"stream_name": "studio", "display_name": "Studio 2"}`)))
+		}, "is already in use by another stream"},
+		{"Create, claiming the other's ID", func() *httptest.ResponseRecorder {
+			return serve(e, createStreamHandler, httptest.NewRequest("POST", "/v1/api/streams",
+				strings.NewReader(`{"id": `+strconv.Itoa(studio.ID)+`, "stream_name": "studio", "display_name": "Studio 2"}`)))
+		}, "is already in use by another stream"},
+		{"Rename", func() *httptest.ResponseRecorder {
+			return update(other.ID, `{"stream_name": "studio", "display_name": "Other"}`)
+		}, "is already in use by another stream"},
+		{"Channel's playback name", func() *httptest.ResponseRecorder {
+			return update(other.ID, `{"stream_name": "main", "display_name": "Other"}`)
+		}, "is in use as a channel's playback_name"},
+	}
+	for _, test := range tests {
+		r := test.do()
+		if r.Code != http.StatusConflict {
+			t.Errorf("%s: got %d, want 409: %s", test.name, r.Code, r.Body)
+			continue
+		}
+		var p problem
+		if err := json.Unmarshal(r.Body.Bytes(), &p); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if p.Type != problemDuplicate || len(p.Fields) != 1 || p.Fields[0] != (fieldError{"stream_name", test.msg}) {
+			t.Errorf("%s: problem is %+v", test.name, p)
+		}
+	}
+
+	// A stream keeping its own name doesn't clash with itself
+	if w := update(studio.ID, `{"stream_name": "studio", "display_name": "Studio"}`); w.Code != http.StatusOK {
+		t.Errorf("Update keeping the name got %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultPosterMaxSize = 5 << 20
+
+// Poster images are sniffed rather than trusted from the upload's content type
+var posterTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// streamLink is an external link shown alongside a stream
+type streamLink struct {
+	Title string `json:"title"`
+	URL   string `json:"url" openapi:"required,format=uri"`
+}
+
+// linkList is a list of links stored as JSON in a single column
+type linkList []streamLink
+
+func (l linkList) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(l)
+	return string(b), err
+}
+
+func (l *linkList) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	case nil:
+	default:
+		return errors.New("Unsupported type for link list")
+	}
+	*l = linkList{}
+	if len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, l)
+}
+
+// validURL checks an external URL is absolute and http(s)
+func validURL(u string) bool {
+	parsed, err := url.Parse(u)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// posterPath returns the URL path an uploaded poster is served from
+func posterPath(streamID int) string {
+	return "/v1/public/streams/" + strconv.Itoa(streamID) + "/poster"
+}
+
+// validateMetadata normalises a stream's tags and checks its URLs
+func (s *stream) validateMetadata() error {
+	tags := make(stringList, 0, len(s.Tags))
+	seen := make(map[string]bool)
+	for _, tag := range s.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if strings.Contains(tag, ",") {
+			return errors.New("Tags may not contain commas")
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	s.Tags = tags
+	s.Category = strings.TrimSpace(s.Category)
+
+	if s.PosterURL != "" && s.PosterURL != posterPath(s.ID) && !validURL(s.PosterURL) {
+		return errors.New("poster_url must be an http or https URL")
+	}
+	if s.Links == nil {
+		s.Links = linkList{}
+	}
+	for _, l := range s.Links {
+		if !validURL(l.URL) {
+			return fmt.Errorf("Invalid link URL: %s", l.URL)
+		}
+	}
+	return nil
+}
+
+// hasTags returns true if a stream has all of the given tags
+func (s *stream) hasTags(tags []string) bool {
+	for _, want := range tags {
+		found := false
+		for _, tag := range s.Tags {
+			if tag == strings.ToLower(want) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// searchScore scores how well a stream matches some search terms. Every term
+// must appear in the display name, tags or description, with matches in the
+// name counting most. Returns 0 if the stream doesn't match.
+func (s *stream) searchScore(terms []string) int {
+	name := strings.ToLower(s.DisplayName + " " + s.StreamName)
+	description := strings.ToLower(s.Description)
+	score := 0
+	for _, term := range terms {
+		termScore := 0
+		if strings.Contains(name, term) {
+			termScore += 3
+		}
+		for _, tag := range s.Tags {
+			if tag == term {
+				termScore += 2
+				break
+			}
+		}
+		if strings.Contains(description, term) {
+			termScore++
+		}
+		if termScore == 0 {
+			return 0
+		}
+		score += termScore
+	}
+	return score
+}
+
+// filterStreams applies the tag and category query parameters of a listing
+func filterStreams(r *http.Request, streams []stream) []stream {
+	if err := r.ParseForm(); err != nil {
+		return streams
+	}
+	tags := r.Form["tag"]
+	category := r.FormValue("category")
+	filtered := make([]stream, 0, len(streams))
+	for _, s := range streams {
+		if category != "" && !strings.EqualFold(s.Category, category) {
+			continue
+		}
+		if s.hasTags(tags) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// searchStreams searches streams' names, descriptions and tags for the words
+// in the "q" query parameter. Results are ordered best match first, and can be
+// filtered like the stream listing.
+func (e *env) searchStreams(r *http.Request, query string) ([]stream, error) {
+	terms := strings.Fields(strings.ToLower(r.FormValue("q")))
+	if len(terms) == 0 {
+		return nil, statusError{
+			400,
+			errors.New("No search terms given"),
+		}
+	}
+
+	streams := make([]stream, 0)
+	if err := e.db.Select(&streams, query); err != nil {
+		requestLog(r).Errorf("Error querying for stream(s): %s", err.Error())
+		return nil, err
+	}
+
+	scores := make(map[int]int)
+	results := make([]stream, 0)
+	for _, s := range filterStreams(r, streams) {
+		if score := s.searchScore(terms); score > 0 {
+			scores[s.ID] = score
+			results = append(results, s)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return scores[results[i].ID] > scores[results[j].ID] })
+	return results, nil
+}
+
+func searchStreamsHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	results, err := e.searchStreams(r, streamSQL)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// posterFile returns where a stream's uploaded poster is stored
+func (e *env) posterFile(streamID int) string {
+	return filepath.Join(e.conf.Posters.Dir, "stream-"+strconv.Itoa(streamID))
+}
+
+// Stores an uploaded poster image, given as the request body, and points the stream's poster_url
+// at it.
+func uploadPosterHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	s, err := e.streamByID(r, mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	if e.conf.Posters.Dir == "" {
+		return statusError{
+			404,
+			errors.New("Poster uploads are not enabled"),
+		}
+	}
+
+	maxSize := e.conf.Posters.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultPosterMaxSize
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > maxSize {
+		return statusError{
+			413,
+			fmt.Errorf("Poster larger than %d bytes", maxSize),
+		}
+	}
+	if !posterTypes[http.DetectContentType(data)] {
+		return statusError{
+			415,
+			errors.New("Poster must be a PNG, JPEG, GIF or WebP image"),
+		}
+	}
+
+	if err := os.MkdirAll(e.conf.Posters.Dir, 0755); err != nil {
+		return err
+	}
+	// Write then rename, so a poster is never served half-written
+	tmp := e.posterFile(s.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, e.posterFile(s.ID)); err != nil {
+		return err
+	}
+
+	s.PosterURL = posterPath(s.ID)
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE streams SET poster_url = $2 WHERE id() = $1`, int64(s.ID), s.PosterURL)
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(&s); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+	}
+	return nil
+}
+
+func getPosterHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	s, err := e.streamByID(r, mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	return e.servePoster(w, r, s)
+}
+
+// servePoster serves a stream's uploaded poster image
+func (e *env) servePoster(w http.ResponseWriter, r *http.Request, s stream) error {
+	if e.conf.Posters.Dir == "" {
+		return statusError{
+			404,
+			errors.New("Poster uploads are not enabled"),
+		}
+	}
+	f, err := os.Open(e.posterFile(s.ID))
+	if os.IsNotExist(err) {
+		return statusError{
+			404,
+			errors.New("Stream has no uploaded poster"),
+		}
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// ServeContent sniffs the type, since the file has no extension
+	http.ServeContent(w, r, "", info.ModTime(), f)
+	return nil
+}
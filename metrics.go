@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metric is a counter or gauge, optionally split by a single label, exposed in
+// the Prometheus text format
+type metric struct {
+	name  string
+	help  string
+	kind  string // counter or gauge
+	label string // Name of the label values are split by, if any
+
+	mu     sync.Mutex
+	values map[string]float64
+	fn     func() float64 // Computes a gauge's value when scraped
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []*metric
+)
+
+func registerMetric(m *metric) *metric {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	m.values = make(map[string]float64)
+	metrics = append(metrics, m)
+	return m
+}
+
+// newCounter registers a counter. If label is given, each value of the label
+// is counted separately.
+func newCounter(name, help, label string) *metric {
+	return registerMetric(&metric{name: name, help: help, kind: "counter", label: label})
+}
+
+// newGaugeFunc registers a gauge whose value is computed by fn when scraped
+func newGaugeFunc(name, help string, fn func() float64) *metric {
+	return registerMetric(&metric{name: name, help: help, kind: "gauge", fn: fn})
+}
+
+// inc adds one to the counter for a label value
+func (m *metric) inc(labelValue string) {
+	m.add(labelValue, 1)
+}
+
+func (m *metric) add(labelValue string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[labelValue] += v
+}
+
+// write renders the metric in the Prometheus text format
+func (m *metric) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if m.fn != nil {
+		fmt.Fprintf(b, "%s %g\n", m.name, m.fn())
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.label == "" {
+		fmt.Fprintf(b, "%s %g\n", m.name, m.values[""])
+		return
+	}
+	labelValues := make([]string, 0, len(m.values))
+	for lv := range m.values {
+		labelValues = append(labelValues, lv)
+	}
+	sort.Strings(labelValues)
+	for _, lv := range labelValues {
+		fmt.Fprintf(b, "%s{%s=%q} %g\n", m.name, m.label, lv, m.values[lv])
+	}
+}
+
+// Exposes metrics in the Prometheus text format
+func metricsHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	metricsMu.Lock()
+	registered := append([]*metric(nil), metrics...)
+	metricsMu.Unlock()
+
+	var b strings.Builder
+	for _, m := range registered {
+		m.write(&b)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, err := w.Write([]byte(b.String()))
+	return err
+}
@@ -0,0 +1,9 @@
+CREATE TABLE nodes (
+    name string NOT NULL,
+    rtmp_url string NOT NULL,
+    region string,
+    capacity int64,
+    registered_at time
+);
+
+CREATE UNIQUE INDEX node_name_unique ON nodes (name);
@@ -0,0 +1,7 @@
+CREATE TABLE ingest_assignments (
+    stream_id int64 NOT NULL,
+    node string NOT NULL,
+    assigned_at time
+);
+
+CREATE UNIQUE INDEX ingest_assignment_stream_unique ON ingest_assignments (stream_id);
@@ -0,0 +1,11 @@
+CREATE TABLE recordings (
+    stream_id int64,
+    stream_name string NOT NULL,
+    session string,
+    path string NOT NULL,
+    size int64,
+    duration_ms int64,
+    recorded_at time
+);
+
+CREATE INDEX recording_stream ON recordings (stream_id);
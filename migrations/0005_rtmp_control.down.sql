@@ -0,0 +1,2 @@
+DROP TABLE audit_log;
+ALTER TABLE nodes DROP COLUMN control_url;
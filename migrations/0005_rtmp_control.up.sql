@@ -0,0 +1,9 @@
+ALTER TABLE nodes ADD control_url string;
+
+CREATE TABLE audit_log (
+    at time NOT NULL,
+    actor string NOT NULL,
+    action string NOT NULL,
+    target string,
+    detail string
+);
@@ -0,0 +1 @@
+ALTER TABLE nodes ADD stat_url string;
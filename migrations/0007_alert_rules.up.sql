@@ -0,0 +1,11 @@
+CREATE TABLE alert_rules (
+    name string NOT NULL,
+    kind string NOT NULL,
+    stream string,
+    node string,
+    threshold float64,
+    for_seconds int64,
+    window_seconds int64
+);
+
+CREATE UNIQUE INDEX alert_rule_name_unique ON alert_rules (name);
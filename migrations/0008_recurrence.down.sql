@@ -0,0 +1,3 @@
+DROP TABLE stream_exceptions;
+ALTER TABLE streams DROP COLUMN timezone;
+ALTER TABLE streams DROP COLUMN rrule;
@@ -0,0 +1,12 @@
+ALTER TABLE streams ADD rrule string;
+ALTER TABLE streams ADD timezone string;
+
+CREATE TABLE stream_exceptions (
+    stream_id int64 NOT NULL,
+    occurrence time NOT NULL,
+    cancelled bool,
+    start_at time,
+    end_at time
+);
+
+CREATE INDEX stream_exception_stream ON stream_exceptions (stream_id);
@@ -0,0 +1 @@
+ALTER TABLE streams ADD resources string;
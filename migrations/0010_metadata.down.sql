@@ -0,0 +1,5 @@
+ALTER TABLE streams DROP COLUMN links;
+ALTER TABLE streams DROP COLUMN poster_url;
+ALTER TABLE streams DROP COLUMN category;
+ALTER TABLE streams DROP COLUMN tags;
+ALTER TABLE streams DROP COLUMN description;
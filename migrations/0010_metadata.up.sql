@@ -0,0 +1,5 @@
+ALTER TABLE streams ADD description string;
+ALTER TABLE streams ADD tags string;
+ALTER TABLE streams ADD category string;
+ALTER TABLE streams ADD poster_url string;
+ALTER TABLE streams ADD links string;
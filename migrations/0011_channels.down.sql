@@ -0,0 +1,2 @@
+ALTER TABLE streams DROP COLUMN channel_id;
+DROP TABLE channels;
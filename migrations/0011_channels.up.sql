@@ -0,0 +1,12 @@
+CREATE TABLE channels (
+    name string NOT NULL,
+    display_name string,
+    description string,
+    playback_name string NOT NULL,
+    created_at time
+);
+
+CREATE UNIQUE INDEX channel_name_unique ON channels (name);
+CREATE UNIQUE INDEX channel_playback_name_unique ON channels (playback_name);
+
+ALTER TABLE streams ADD channel_id int64;
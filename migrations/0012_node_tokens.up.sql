@@ -0,0 +1 @@
+ALTER TABLE nodes ADD token_hash string;
@@ -0,0 +1,3 @@
+ALTER TABLE streams DROP COLUMN state_since;
+ALTER TABLE streams DROP COLUMN state;
+DROP TABLE stream_transitions;
@@ -0,0 +1,12 @@
+ALTER TABLE streams ADD state string;
+ALTER TABLE streams ADD state_since time;
+
+CREATE TABLE stream_transitions (
+    stream_id int64 NOT NULL,
+    from_state string,
+    to_state string NOT NULL,
+    reason string,
+    at time NOT NULL
+);
+
+CREATE INDEX stream_transitions_stream ON stream_transitions (stream_id);
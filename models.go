@@ -1,11 +1,75 @@
 package main
 
+import "time"
+
 type stream struct {
-	ID          int      `db:"id" json:"id"`
-	DisplayName string   `db:"display_name" json:"display_name"`
-	IsPublic    bool     `db:"is_public" json:"is_public"`
-	StartAt     nullTime `db:"start_at" json:"start_at"`
-	EndAt       nullTime `db:"end_at" json:"end_at"`
-	StreamName  string   `db:"stream_name" json:"stream_name"`
-	Key         string   `db:"key" json:"key"`
+	ID          int         `db:"id" json:"id" openapi:"readonly"`
+	DisplayName string      `db:"display_name" json:"display_name" openapi:"required"`
+	IsPublic    bool        `db:"is_public" json:"is_public"`
+	StartAt     nullTime    `db:"start_at" json:"start_at"`
+	EndAt       nullTime    `db:"end_at" json:"end_at"`
+	StreamName  string      `db:"stream_name" json:"stream_name" openapi:"required,pattern=^[A-Za-z0-9_.-]+$"`
+	KeyHash     string      `db:"key" json:"-"`               // Salted hash. The key itself is only shown at creation or rotation
+	RRule       string      `db:"rrule" json:"rrule"`         // RFC 5545 recurrence rule, if the stream repeats
+	Timezone    string      `db:"timezone" json:"timezone"`   // IANA time zone the recurrence is evaluated in
+	Resources   stringList  `db:"resources" json:"resources"` // Shared resources the stream books, as kind:name
+	Description string      `db:"description" json:"description"`
+	Tags        stringList  `db:"tags" json:"tags"`
+	Category    string      `db:"category" json:"category"`
+	PosterURL   string      `db:"poster_url" json:"poster_url"` // External image, or the uploaded poster
+	Links       linkList    `db:"links" json:"links"`
+	ChannelID   int         `db:"channel_id" json:"channel_id" openapi:"min=0"` // Zero if the stream isn't part of a channel
+	State       streamState `db:"state" json:"state" openapi:"readonly"`
+	StateSince  nullTime    `db:"state_since" json:"state_since" openapi:"readonly"`
+}
+
+// channel is a permanent station output, which many scheduled streams belong to
+type channel struct {
+	ID           int      `db:"id" json:"id" openapi:"readonly"`
+	Name         string   `db:"name" json:"name" openapi:"required,pattern=^[a-z0-9][a-z0-9_-]*$"`
+	DisplayName  string   `db:"display_name" json:"display_name"`
+	Description  string   `db:"description" json:"description"`
+	PlaybackName string   `db:"playback_name" json:"playback_name" openapi:"required,pattern=^[a-z0-9][a-z0-9_-]*$"` // Stable name viewers play, mapped to whichever stream is live
+	CreatedAt    nullTime `db:"created_at" json:"created_at" openapi:"readonly"`
+}
+
+// streamException cancels or moves one occurrence of a recurring stream
+type streamException struct {
+	ID         int       `db:"id" json:"id" openapi:"readonly"`
+	StreamID   int       `db:"stream_id" json:"stream_id" openapi:"readonly"`
+	Occurrence time.Time `db:"occurrence" json:"occurrence" openapi:"required"` // Original start of the occurrence
+	Cancelled  bool      `db:"cancelled" json:"cancelled"`
+	StartAt    nullTime  `db:"start_at" json:"start_at"` // New start, if moved
+	EndAt      nullTime  `db:"end_at" json:"end_at"`
+}
+
+type node struct {
+	ID           int      `db:"id" json:"id" openapi:"readonly"`
+	Name         string   `db:"name" json:"name" openapi:"required"`
+	RTMPURL      string   `db:"rtmp_url" json:"rtmp_url" openapi:"required,format=uri"`
+	ControlURL   string   `db:"control_url" json:"control_url" openapi:"format=uri"` // Base URL of nginx-rtmp's control module
+	StatURL      string   `db:"stat_url" json:"stat_url" openapi:"format=uri"`       // URL of nginx-rtmp's stat module XML
+	Region       string   `db:"region" json:"region"`
+	Capacity     int      `db:"capacity" json:"capacity" openapi:"min=0"`
+	RegisteredAt nullTime `db:"registered_at" json:"registered_at" openapi:"readonly"`
+}
+
+type recording struct {
+	ID         int      `db:"id" json:"id"`
+	StreamID   int      `db:"stream_id" json:"stream_id"`
+	StreamName string   `db:"stream_name" json:"stream_name"`
+	Session    string   `db:"session" json:"session"`
+	Path       string   `db:"path" json:"path"`
+	Size       int64    `db:"size" json:"size"`
+	DurationMS int64    `db:"duration_ms" json:"duration_ms"`
+	RecordedAt nullTime `db:"recorded_at" json:"recorded_at"`
+}
+
+type auditEntry struct {
+	ID     int      `db:"id" json:"id"`
+	At     nullTime `db:"at" json:"at"`
+	Actor  string   `db:"actor" json:"actor"`
+	Action string   `db:"action" json:"action"`
+	Target string   `db:"target" json:"target"`
+	Detail string   `db:"detail" json:"detail"`
 }
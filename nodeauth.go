@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Node tokens are made like stream keys, but longer and with their own prefix
+const (
+	nodeTokenLength = 32
+	nodeTokenPrefix = "nxn_"
+)
+
+// nodeToken is the response of the node token rotation endpoint
+type nodeToken struct {
+	Node  string `json:"node"`
+	Token string `json:"token"`
+}
+
+// newNodeToken generates a node token, returning it and its hash
+func newNodeToken() (string, string, error) {
+	g, err := newKeyGenerator(nodeTokenLength, "", nodeTokenPrefix)
+	if err != nil {
+		return "", "", err
+	}
+	token, err := g.generate()
+	if err != nil {
+		return "", "", err
+	}
+	hash, err := hashKey(token)
+	if err != nil {
+		return "", "", err
+	}
+	return token, hash, nil
+}
+
+// authenticateNode identifies the ingest node making a request, by the common
+// name of a verified client certificate, or by its bearer token
+func (e *env) authenticateNode(r *http.Request) (string, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		var n int
+		if err := e.db.Get(&n, `SELECT count(*) FROM nodes WHERE name = $1`, name); err != nil {
+			return "", err
+		}
+		if n == 0 {
+			return "", statusError{
+				http.StatusForbidden,
+				errors.New("Client certificate is not for a registered node"),
+			}
+		}
+		return name, nil
+	}
+
+	token := bearerToken(r)
+	if token == "" {
+		return "", statusError{
+			http.StatusUnauthorized,
+			errors.New("Node token or client certificate required"),
+		}
+	}
+	var rows []struct {
+		Name      string `db:"name"`
+		TokenHash string `db:"token_hash"`
+	}
+	if err := e.db.Select(&rows, `SELECT name, token_hash FROM nodes`); err != nil {
+		return "", err
+	}
+	name := ""
+	for _, row := range rows {
+		// Check every node, so the time taken doesn't reveal which matched
+		if keyMatches(row.TokenHash, token) && name == "" {
+			name = row.Name
+		}
+	}
+	if name == "" {
+		return "", statusError{
+			http.StatusUnauthorized,
+			errors.New("Invalid node token"),
+		}
+	}
+	return name, nil
+}
+
+// Replaces the token an ingest node authenticates with, returning the new token. This is the only
+// time it is shown. Every rotation is audited.
+func rotateNodeTokenHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	name := mux.Vars(r)["name"]
+	token, hash, err := newNodeToken()
+	if err != nil {
+		requestLog(r).Errorf("Error generating node token: %s", err.Error())
+		return err
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`UPDATE nodes SET token_hash = $2 WHERE name = $1`, name, hash)
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return statusError{
+			404,
+			errors.New("Node not found"),
+		}
+	}
+	e.audit(actorFromRequest(r), "rotate_node_token", name, "")
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(nodeToken{name, token}); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/ystv/nexus-common"
+)
+
+const defaultHeartbeatTimeout = 30 * time.Second
+
+// nodeHealthEvent is sent to the updates hub when a node goes offline or recovers
+type nodeHealthEvent struct {
+	Node    string `json:"node"`
+	Healthy bool   `json:"healthy"`
+}
+
+// nodeState is the runtime state of a registered ingest node, as learned from
+// its heartbeats
+type nodeState struct {
+	LastSeen time.Time
+	Healthy  bool
+	Clients  int
+	StatErr  string // Last error polling the node's stat module, if any
+}
+
+// nodeStatus is a registered node together with its runtime state, as returned
+// by the API
+type nodeStatus struct {
+	node
+	Healthy  bool     `json:"healthy"`
+	LastSeen nullTime `json:"last_seen"`
+	Clients  int      `json:"clients"`
+	Streams  []string `json:"streams"`
+	StatErr  string   `json:"stat_error,omitempty"`
+}
+
+// nodeRegistry tracks heartbeats of registered ingest nodes
+type nodeRegistry struct {
+	mu      sync.Mutex
+	states  map[string]*nodeState
+	timeout time.Duration
+}
+
+func newNodeRegistry(timeout time.Duration) *nodeRegistry {
+	if timeout <= 0 {
+		timeout = defaultHeartbeatTimeout
+	}
+	return &nodeRegistry{
+		states:  make(map[string]*nodeState),
+		timeout: timeout,
+	}
+}
+
+// load adds all nodes stored in the database to the registry
+func (n *nodeRegistry) load(db *sqlx.DB) error {
+	var names []string
+	if err := db.Select(&names, `SELECT name FROM nodes`); err != nil {
+		return err
+	}
+	for _, name := range names {
+		n.add(name)
+	}
+	return nil
+}
+
+// add starts tracking a node. Newly added nodes are unhealthy until they send
+// their first heartbeat.
+func (n *nodeRegistry) add(name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.states[name]; !ok {
+		n.states[name] = &nodeState{}
+	}
+}
+
+func (n *nodeRegistry) remove(name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.states, name)
+}
+
+// heartbeat records a heartbeat from a node. Returns an error if the node has
+// not been registered, and true if the node has just become healthy.
+func (n *nodeRegistry) heartbeat(name string, clients int) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	s, ok := n.states[name]
+	if !ok {
+		return false, errors.New("Unknown node: " + name)
+	}
+	recovered := !s.Healthy
+	s.LastSeen = time.Now()
+	s.Healthy = true
+	s.Clients = clients
+	return recovered, nil
+}
+
+// state returns a copy of the runtime state of a node
+func (n *nodeRegistry) state(name string) nodeState {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if s, ok := n.states[name]; ok {
+		return *s
+	}
+	return nodeState{}
+}
+
+// setStatError records the result of polling a node's stat module
+func (n *nodeRegistry) setStatError(name string, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if s, ok := n.states[name]; ok {
+		s.StatErr = ""
+		if err != nil {
+			s.StatErr = err.Error()
+		}
+	}
+}
+
+// expire marks nodes which have missed their heartbeats as unhealthy, and
+// returns their names
+func (n *nodeRegistry) expire() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	expired := make([]string, 0)
+	for name, s := range n.states {
+		if s.Healthy && time.Since(s.LastSeen) > n.timeout {
+			s.Healthy = false
+			expired = append(expired, name)
+		}
+	}
+	return expired
+}
+
+// watchNodes periodically checks for nodes which have stopped sending
+// heartbeats, and takes all streams hosted on them offline
+func (e *env) watchNodes() {
+	ticker := time.NewTicker(e.nodes.timeout / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, name := range e.nodes.expire() {
+			nodesLog.Warnf("Ingest node %s missed its heartbeat, marking offline", name)
+			e.publishEvent(eventNodeStatus, nodeHealthEvent{name, false})
+			for _, stream := range e.live.onNode(name) {
+				e.setStreamOffline(stream)
+			}
+		}
+	}
+}
+
+// setStreamOnline marks a stream as live on a node, and tells clients of the
+// updates hub if it wasn't already
+func (e *env) setStreamOnline(name, node, clientAddr string) {
+	if !e.live.setOnline(name, node) {
+		return
+	}
+	e.deriveState(name, stateLive, "live on "+node, stateDraft, stateScheduled, stateStarting, stateEnded)
+	e.publishEvent(eventStreamStatus, streamStatusEvent{
+		StreamName:    name,
+		Node:          node,
+		Status:        nexus_common.StreamStatusOnline,
+		ClientAddress: clientAddr,
+	})
+}
+
+// setStreamOffline removes a stream from the live registry and tells clients
+// of the updates hub it has gone
+func (e *env) setStreamOffline(name string) {
+	s, ok := e.live.get(name)
+	if !ok || !e.live.setOffline(name) {
+		return
+	}
+	e.deriveState(name, stateEnded, "no longer live on "+s.Node, stateStarting, stateLive, stateDegraded)
+	e.publishEvent(eventStreamStatus, streamStatusEvent{
+		StreamName: name,
+		Node:       s.Node,
+		Status:     nexus_common.StreamStatusTerminating,
+	})
+}
+
+// heartbeatMessage is sent periodically by each ingest node over the
+// streamstatus websocket
+type heartbeatMessage struct {
+	statusEnvelope
+	Node    string   `json:"node"`
+	Streams []string `json:"streams"` // Names of all streams currently published to the node
+	Clients int      `json:"clients"` // Number of connected RTMP clients
+}
+
+// handleHeartbeat updates the node registry and the streams live on the node
+// from a heartbeat. Streams it can't report on get an error reply to m.
+func (e *env) handleHeartbeat(m *Message, hb *heartbeatMessage) error {
+	recovered, err := e.nodes.heartbeat(hb.Node, hb.Clients)
+	if err != nil {
+		return err
+	}
+	if recovered {
+		nodesLog.Infof("Ingest node %s is healthy", hb.Node)
+		e.publishEvent(eventNodeStatus, nodeHealthEvent{hb.Node, true})
+	}
+
+	// The heartbeat's stream list is authoritative for that node, except that
+	// it can't take over streams live on another node. Each stream is checked
+	// like a stream update.
+	hosted := make(map[string]bool)
+	for _, name := range hb.Streams {
+		update := streamUpdateMessage{StreamName: name, Status: nexus_common.StreamStatusOnline}
+		if err := e.validateStreamUpdate(&update); err != nil {
+			e.rejectStatusMessage(m, name, err)
+			continue
+		}
+		if err := e.checkUpdateNode(hb.Node, &update); err != nil {
+			e.rejectStatusMessage(m, name, messageError{errCodeForbidden, err})
+			continue
+		}
+		hosted[name] = true
+		e.setStreamOnline(name, hb.Node, "")
+	}
+	for _, name := range e.live.onNode(hb.Node) {
+		if !hosted[name] {
+			e.setStreamOffline(name)
+		}
+	}
+	return nil
+}
+
+// nodeStatuses returns all registered nodes along with their runtime state
+func (e *env) nodeStatuses() ([]nodeStatus, error) {
+	nodes := make([]node, 0)
+	err := e.db.Select(&nodes, `
+		SELECT
+			id() as id, name, rtmp_url, control_url, stat_url, region, capacity, registered_at
+		FROM
+			nodes
+		ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]nodeStatus, 0, len(nodes))
+	for _, n := range nodes {
+		s := e.nodes.state(n.Name)
+		status := nodeStatus{
+			node:    n,
+			Healthy: s.Healthy,
+			Clients: s.Clients,
+			Streams: e.live.onNode(n.Name),
+			StatErr: s.StatErr,
+		}
+		if !s.LastSeen.IsZero() {
+			status.LastSeen = toNullTime(s.LastSeen)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func getNodesHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	statuses, err := e.nodeStatuses()
+	if err != nil {
+		requestLog(r).Errorf("Error querying for nodes: %s", err.Error())
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// registeredNode is a node as returned on registration. A newly registered
+// node gets the only copy of the token it authenticates with.
+type registeredNode struct {
+	node
+	Token string `json:"token,omitempty"`
+}
+
+// Registers an ingest node, or updates the details of an existing node with
+// the same name
+func registerNodeHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	var n node
+	if err := decodeBody(w, r, &n); err != nil {
+		return err
+	}
+	if n.Name == "" || n.RTMPURL == "" {
+		return statusError{
+			400,
+			errors.New("Node name and rtmp_url are required"),
+		}
+	}
+
+	tx, err := e.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	var existing node
+	var token string
+	err = tx.Get(&existing, `SELECT id() as id, registered_at FROM nodes WHERE name = $1`, n.Name)
+	switch {
+	case err == sql.ErrNoRows:
+		var hash string
+		if token, hash, err = newNodeToken(); err != nil {
+			break
+		}
+		n.RegisteredAt = toNullTime(time.Now())
+		_, err = tx.Exec(`
+			INSERT INTO nodes (
+				name, rtmp_url, control_url, stat_url, region, capacity, registered_at, token_hash
+			) VALUES (
+				$1, $2, $3, $4, $5, $6, $7, $8
+			)`,
+			n.Name, n.RTMPURL, n.ControlURL, n.StatURL, n.Region, int64(n.Capacity), n.RegisteredAt, hash,
+		)
+	case err == nil:
+		n.RegisteredAt = existing.RegisteredAt
+		_, err = tx.Exec(`
+			UPDATE nodes
+			SET rtmp_url = $2, control_url = $3, stat_url = $4, region = $5, capacity = $6
+			WHERE name = $1`,
+			n.Name, n.RTMPURL, n.ControlURL, n.StatURL, n.Region, int64(n.Capacity),
+		)
+	}
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := e.db.Get(&n.ID, `SELECT id() FROM nodes WHERE name = $1`, n.Name); err != nil {
+		requestLog(r).Errorf("Error retrieving ID of node: %s", err.Error())
+	}
+	e.nodes.add(n.Name)
+	requestLog(r).Infof("Registered ingest node %s (%s)", n.Name, n.RTMPURL)
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(&registeredNode{n, token}); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+	}
+	return nil
+}
+
+func deleteNodeHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	name := mux.Vars(r)["name"]
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`DELETE FROM nodes WHERE name = $1`, name)
+	if err != nil {
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return statusError{
+			404,
+			errors.New("Node not found"),
+		}
+	}
+
+	e.nodes.remove(name)
+	for _, stream := range e.live.onNode(name) {
+		e.setStreamOffline(stream)
+	}
+	return nil
+}
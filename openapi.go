@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxRequestBody = 1 << 20
+
+// schema is an OpenAPI 3 schema object. Schemas are generated from the Go
+// types the API encodes and decodes, with constraints for request validation
+// given in "openapi" struct tags:
+//
+//	required       The field must be present
+//	readonly       Set by the server; ignored in requests
+//	pattern=re     The string must match re
+//	enum=a|b       The string must be one of the values
+//	format=f       date-time, uri or duration
+//	min=n          The number must be at least n
+type schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	AllOf                []*schema          `json:"allOf,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	ReadOnly             bool               `json:"readOnly,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"` // false, or a *schema
+
+	pattern *regexp.Regexp // Pattern, compiled when the schema is generated
+}
+
+// fieldError says which field of a request body failed validation, and why
+type fieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// validationError is returned when a request body doesn't match its schema
+type validationError struct {
+	fields []fieldError
+}
+
+func (v validationError) Error() string {
+	if len(v.fields) == 1 {
+		return "Invalid request body: " + v.fields[0].Field + " " + v.fields[0].Error
+	}
+	return "Invalid request body"
+}
+
+func (v validationError) Status() int {
+	return http.StatusBadRequest
+}
+
+// apiErrorBody is the JSON body of every error response
+type apiErrorBody struct {
+	Error  string       `json:"error"`
+	Fields []fieldError `json:"fields,omitempty"` // Set when a request body failed validation
+}
+
+// schemaGenerator builds schemas from Go types, collecting named struct types
+// as components
+type schemaGenerator struct {
+	components map[string]*schema
+	err        error // The first invalid openapi tag found
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	nullTimeType = reflect.TypeOf(nullTime{})
+	durationType = reflect.TypeOf(duration{})
+)
+
+func (g *schemaGenerator) schemaOf(t reflect.Type) *schema {
+	switch t {
+	case timeType:
+		return &schema{Type: "string", Format: "date-time"}
+	case nullTimeType:
+		return &schema{Type: "string", Format: "date-time", Nullable: true}
+	case durationType:
+		return &schema{Type: "string", Format: "duration"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := g.schemaOf(t.Elem())
+		if s.Ref != "" {
+			// Siblings of $ref are ignored, so wrap it to make it nullable
+			return &schema{AllOf: []*schema{s}, Nullable: true}
+		}
+		s.Nullable = true
+		return s
+	case reflect.Bool:
+		return &schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &schema{Type: "number"}
+	case reflect.String:
+		return &schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &schema{Type: "array", Items: g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &schema{Type: "object", AdditionalProperties: g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.components[t.Name()]; !ok {
+			g.components[t.Name()] = &schema{} // Placeholder, in case the type refers to itself
+			g.components[t.Name()] = g.structSchema(t)
+		}
+		return &schema{Ref: "#/components/schemas/" + t.Name()}
+	}
+	return &schema{} // Anything
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) *schema {
+	s := &schema{
+		Type:                 "object",
+		Properties:           make(map[string]*schema),
+		AdditionalProperties: false,
+	}
+	g.addFields(s, t)
+	return s
+}
+
+// addFields adds the fields of a struct to an object schema, following the
+// encoding/json rules for names and embedded structs
+func (g *schemaGenerator) addFields(s *schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			g.addFields(s, f.Type)
+			continue
+		}
+		if f.PkgPath != "" { // Unexported
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		fs := g.schemaOf(f.Type)
+		if opts := f.Tag.Get("openapi"); opts != "" {
+			if fs.Ref != "" {
+				fs = &schema{AllOf: []*schema{fs}}
+			}
+			for _, opt := range strings.Split(opts, ",") {
+				if err := g.applyTag(s, fs, name, opt); err != nil && g.err == nil {
+					g.err = fmt.Errorf("Invalid openapi tag on %s.%s: %s", t.Name(), f.Name, err.Error())
+				}
+			}
+		}
+		s.Properties[name] = fs
+	}
+}
+
+// applyTag applies one option of a field's openapi tag to its schema, fs, and
+// the schema of its struct, s
+func (g *schemaGenerator) applyTag(s, fs *schema, name, opt string) error {
+	kv := strings.SplitN(opt, "=", 2)
+	switch kv[0] {
+	case "required":
+		s.Required = append(s.Required, name)
+		return nil
+	case "readonly":
+		fs.ReadOnly = true
+		return nil
+	}
+	if len(kv) != 2 {
+		return fmt.Errorf("%s needs a value", kv[0])
+	}
+	switch kv[0] {
+	case "pattern":
+		re, err := regexp.Compile(kv[1])
+		if err != nil {
+			return err
+		}
+		fs.Pattern, fs.pattern = kv[1], re
+	case "enum":
+		fs.Enum = strings.Split(kv[1], "|")
+	case "format":
+		fs.Format = kv[1]
+	case "min":
+		min, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			return err
+		}
+		fs.Minimum = &min
+	default:
+		return fmt.Errorf("unknown option %s", kv[0])
+	}
+	return nil
+}
+
+func (g *schemaGenerator) resolve(s *schema) *schema {
+	for s.Ref != "" {
+		s = g.components[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+// validate checks a value decoded from JSON against a schema, adding an error
+// for each field which doesn't match
+func (g *schemaGenerator) validate(v interface{}, s *schema, field string, errs *[]fieldError) {
+	s = g.resolve(s)
+	fail := func(msg string) {
+		name := field
+		if name == "" {
+			name = "body"
+		}
+		*errs = append(*errs, fieldError{name, msg})
+	}
+
+	if v == nil {
+		if !s.Nullable && (s.Type != "" || len(s.AllOf) > 0) {
+			fail("must not be null")
+		}
+		return
+	}
+	for _, sub := range s.AllOf {
+		g.validate(v, sub, field, errs)
+	}
+
+	switch s.Type {
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			fail("must be a string")
+			return
+		}
+		if len(s.Enum) > 0 {
+			found := false
+			for _, e := range s.Enum {
+				found = found || e == str
+			}
+			if !found {
+				fail("must be one of " + strings.Join(s.Enum, ", "))
+				return
+			}
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			fail("must match " + s.Pattern)
+			return
+		}
+		if str == "" {
+			return
+		}
+		switch s.Format {
+		case "date-time":
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				fail("must be an RFC 3339 date-time")
+			}
+		case "uri":
+			if u, err := url.Parse(str); err != nil || u.Scheme == "" || u.Host == "" {
+				fail("must be an absolute URI")
+			}
+		case "duration":
+			if _, err := time.ParseDuration(str); err != nil {
+				fail("must be a duration such as 30s or 5m")
+			}
+		}
+	case "integer", "number":
+		n, ok := v.(json.Number)
+		if !ok {
+			fail("must be a " + s.Type)
+			return
+		}
+		f, err := n.Float64()
+		if _, ierr := n.Int64(); err != nil || (s.Type == "integer" && ierr != nil) {
+			fail("must be a " + s.Type)
+			return
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			fail("must be at least " + strconv.FormatFloat(*s.Minimum, 'f', -1, 64))
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			fail("must be a boolean")
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			fail("must be an array")
+			return
+		}
+		for i, item := range items {
+			g.validate(item, s.Items, field+"["+strconv.Itoa(i)+"]", errs)
+		}
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			fail("must be an object")
+			return
+		}
+		prefix := field
+		if prefix != "" {
+			prefix += "."
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				*errs = append(*errs, fieldError{prefix + name, "is required"})
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			switch {
+			case ok && prop.ReadOnly:
+			case ok:
+				g.validate(obj[name], prop, prefix+name, errs)
+			case s.AdditionalProperties == false:
+				*errs = append(*errs, fieldError{prefix + name, "is not a known field"})
+			default:
+				if extra, ok := s.AdditionalProperties.(*schema); ok {
+					g.validate(obj[name], extra, prefix+name, errs)
+				}
+			}
+		}
+	}
+}
+
+// apiOperation describes one endpoint in the OpenAPI document
+type apiOperation struct {
+	Method      string
+	Path        string
+	Summary     string
+	Auth        bool
+	Query       []string
+	Request     interface{} // A value of the JSON request body's type
+	RequestType string      // Content type of a non-JSON request body
+	Response    interface{} // A value of the JSON response body's type
+	ContentType string      // Content type of a non-JSON response
+}
+
+// apiOperations lists the HTTP API. Keep it in step with the routes in main.
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/v1/public/streams", Summary: "List public streams", Query: []string{"tag", "category"}, Response: []publicStream{}},
+	{Method: "GET", Path: "/v1/public/streams/search", Summary: "Search public streams", Query: []string{"q", "tag", "category"}, Response: []publicStream{}},
+	{Method: "GET", Path: "/v1/public/streams/{id}", Summary: "Get a public stream", Response: publicStream{}},
+	{Method: "GET", Path: "/v1/public/streams/{id}/occurrences", Summary: "List occurrences of a public stream", Query: []string{"from", "to"}, Response: []occurrence{}},
+	{Method: "GET", Path: "/v1/public/streams/{id}/poster", Summary: "Get the uploaded poster of a public stream", ContentType: "image/*"},
+	{Method: "GET", Path: "/v1/public/channels", Summary: "List channels", Response: []channel{}},
+	{Method: "GET", Path: "/v1/public/channels/{id}", Summary: "Get a channel", Response: channel{}},
+	{Method: "GET", Path: "/v1/public/channels/{id}/now", Summary: "What is on a channel now", Response: (*publicProgramme)(nil)},
+	{Method: "GET", Path: "/v1/public/channels/{id}/next", Summary: "What is on a channel next", Response: (*publicProgramme)(nil)},
+	{Method: "GET", Path: "/v1/calendar.ics", Summary: "iCalendar feed of scheduled streams", Query: []string{"token", "public"}, ContentType: "text/calendar"},
+
+	{Method: "GET", Path: "/v1/api/streams", Summary: "List streams", Auth: true, Query: []string{"tag", "category"}, Response: []stream{}},
+	{Method: "POST", Path: "/v1/api/streams", Summary: "Create a stream", Auth: true, Request: stream{}, Response: streamWithKey{}},
+	{Method: "GET", Path: "/v1/api/streams/search", Summary: "Search streams", Auth: true, Query: []string{"q", "tag", "category"}, Response: []stream{}},
+	{Method: "GET", Path: "/v1/api/streams/{id}", Summary: "Get a stream", Auth: true, Response: stream{}},
+	{Method: "PUT", Path: "/v1/api/streams/{id}", Summary: "Update a stream", Auth: true, Request: stream{}, Response: stream{}},
+	{Method: "DELETE", Path: "/v1/api/streams/{id}", Summary: "Delete a stream", Auth: true},
+	{Method: "GET", Path: "/v1/api/streams/{id}/poster", Summary: "Get a stream's uploaded poster", Auth: true, ContentType: "image/*"},
+	{Method: "PUT", Path: "/v1/api/streams/{id}/poster", Summary: "Upload a poster image", Auth: true, RequestType: "image/*", Response: stream{}},
+	{Method: "POST", Path: "/v1/api/streams/{id}/key/rotate", Summary: "Replace a stream's key, returning the new key. Audited", Auth: true, Response: streamKey{}},
+	{Method: "PUT", Path: "/v1/api/streams/{id}/state", Summary: "Archive a stream, or restore it to draft. Other states follow from the schedule and ingest. Audited", Auth: true, Request: stateChange{}, Response: streamTransition{}},
+	{Method: "GET", Path: "/v1/api/streams/{id}/transitions", Summary: "List a stream's state changes, most recent first", Auth: true, Response: []streamTransition{}},
+	{Method: "GET", Path: "/v1/api/streams/{id}/ingest", Summary: "Assign an ingest node", Auth: true, Query: []string{"region"}, Response: ingestAssignment{}},
+	{Method: "GET", Path: "/v1/api/streams/{id}/occurrences", Summary: "List occurrences of a stream", Auth: true, Query: []string{"from", "to"}, Response: []occurrence{}},
+	{Method: "GET", Path: "/v1/api/streams/{id}/exceptions", Summary: "List exceptions to a stream's recurrence", Auth: true, Response: []streamException{}},
+	{Method: "POST", Path: "/v1/api/streams/{id}/exceptions", Summary: "Cancel or move an occurrence", Auth: true, Request: streamException{}, Response: streamException{}},
+	{Method: "DELETE", Path: "/v1/api/streams/{id}/exceptions/{exid}", Summary: "Delete an exception", Auth: true},
+	{Method: "GET", Path: "/v1/api/schedule/conflicts", Summary: "List schedule conflicts", Auth: true, Query: []string{"from", "to"}, Response: []scheduleConflict{}},
+	{Method: "GET", Path: "/v1/api/streams/{id}/recordings", Summary: "List a stream's recordings", Auth: true, Response: []recording{}},
+	{Method: "GET", Path: "/v1/api/recordings/{id}/download", Summary: "Download a recording", Auth: true, ContentType: "video/x-flv"},
+	{Method: "POST", Path: "/v1/api/streams/{id}/drop", Summary: "Drop a stream's publisher", Auth: true, Response: dropResult{}},
+	{Method: "POST", Path: "/v1/api/streams/{id}/clients/{clientid}/drop", Summary: "Drop a viewer", Auth: true, Response: dropResult{}},
+	{Method: "GET", Path: "/v1/api/channels", Summary: "List channels", Auth: true, Response: []channel{}},
+	{Method: "POST", Path: "/v1/api/channels", Summary: "Create a channel", Auth: true, Request: channel{}, Response: channel{}},
+	{Method: "GET", Path: "/v1/api/channels/{id}", Summary: "Get a channel", Auth: true, Response: channel{}},
+	{Method: "PUT", Path: "/v1/api/channels/{id}", Summary: "Update a channel", Auth: true, Request: channel{}, Response: channel{}},
+	{Method: "DELETE", Path: "/v1/api/channels/{id}", Summary: "Delete a channel", Auth: true},
+	{Method: "GET", Path: "/v1/api/channels/{id}/streams", Summary: "List a channel's streams", Auth: true, Query: []string{"tag", "category"}, Response: []stream{}},
+	{Method: "GET", Path: "/v1/api/channels/{id}/now", Summary: "What is on a channel now", Auth: true, Response: (*programme)(nil)},
+	{Method: "GET", Path: "/v1/api/channels/{id}/next", Summary: "What is on a channel next", Auth: true, Response: (*programme)(nil)},
+	{Method: "GET", Path: "/v1/api/live", Summary: "List live streams", Auth: true, Response: []liveStream{}},
+	{Method: "GET", Path: "/v1/api/nodes", Summary: "List ingest nodes", Auth: true, Response: []nodeStatus{}},
+	{Method: "POST", Path: "/v1/api/nodes", Summary: "Register an ingest node. New nodes get a token for the streamstatus websocket", Auth: true, Request: node{}, Response: registeredNode{}},
+	{Method: "DELETE", Path: "/v1/api/nodes/{name}", Summary: "Remove an ingest node", Auth: true},
+	{Method: "POST", Path: "/v1/api/nodes/{name}/token/rotate", Summary: "Replace a node's token, returning the new token. Audited", Auth: true, Response: nodeToken{}},
+	{Method: "GET", Path: "/v1/api/alerts", Summary: "List firing alerts", Auth: true, Response: []alert{}},
+	{Method: "GET", Path: "/v1/api/alerts/rules", Summary: "List alert rules", Auth: true, Response: []alertRule{}},
+	{Method: "POST", Path: "/v1/api/alerts/rules", Summary: "Create an alert rule", Auth: true, Request: alertRule{}, Response: alertRule{}},
+	{Method: "DELETE", Path: "/v1/api/alerts/rules/{id}", Summary: "Delete an alert rule", Auth: true},
+	{Method: "GET", Path: "/v1/api/audit", Summary: "Read the audit log", Auth: true, Query: []string{"limit"}, Response: []auditEntry{}},
+	{Method: "GET", Path: "/v1/api/lockouts", Summary: "List addresses and stream names locked out after failed publish attempts", Auth: true, Response: []lockout{}},
+	{Method: "DELETE", Path: "/v1/api/lockouts", Summary: "Lift all lockouts. Audited", Auth: true},
+	{Method: "DELETE", Path: "/v1/api/lockouts/{scope}/{key}", Summary: "Lift the lockout of an addr or stream. Audited", Auth: true},
+	{Method: "GET", Path: "/v1/api/hubs", Summary: "List websocket hubs, with their backpressure policy and clients", Auth: true, Response: []hubStatus{}},
+	{Method: "GET", Path: "/v1/api/metrics", Summary: "Metrics in the Prometheus text format", Auth: true, ContentType: "text/plain"},
+}
+
+// Messages exchanged over the websockets, and the data of each event type
+var (
+	updatesMessages      = []interface{}{event{}}
+	streamStatusMessages = []interface{}{heartbeatMessage{}, streamUpdateMessage{}}
+	streamStatusReplies  = []interface{}{statusErrorReply{}}
+	eventTypes           = map[eventType]interface{}{
+		eventNodeStatus:       nodeHealthEvent{},
+		eventStreamStatus:     streamStatusEvent{},
+		eventStreamState:      streamTransition{},
+		eventStreamStats:      streamStatsEvent{},
+		eventPublisherDropped: dropResult{},
+		eventClientDropped:    dropResult{},
+		eventAlertFired:       alert{},
+		eventAlertResolved:    alert{},
+		eventPublishFailed:    publishFailedEvent{},
+		eventPublishLockout:   lockout{},
+		eventMissedEvents:     missedEventsEvent{},
+	}
+)
+
+var pathParamPattern = regexp.MustCompile(`{(\w+)}`)
+
+// openAPIDoc is the generated document, and the generator holding its schemas
+type openAPIDoc struct {
+	gen  *schemaGenerator
+	json []byte
+}
+
+// apiDoc is the OpenAPI document, built by loadOpenAPI at startup
+var apiDoc *openAPIDoc
+
+// loadOpenAPI builds the OpenAPI document, which request bodies are validated
+// against. Invalid openapi struct tags are reported here, rather than when a
+// request first uses them.
+func loadOpenAPI() error {
+	doc, err := buildOpenAPI()
+	if err != nil {
+		return err
+	}
+	apiDoc = doc
+	return nil
+}
+
+func buildOpenAPI() (*openAPIDoc, error) {
+	g := &schemaGenerator{components: make(map[string]*schema)}
+	jsonContent := func(v interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": g.schemaOf(reflect.TypeOf(v))},
+		}
+	}
+	errorResponse := map[string]interface{}{
+		"description": "Error, as RFC 7807 problem details unless the client only accepts application/json",
+		"content": map[string]interface{}{
+			"application/problem+json": map[string]interface{}{"schema": g.schemaOf(reflect.TypeOf(problem{}))},
+			"application/json":         map[string]interface{}{"schema": g.schemaOf(reflect.TypeOf(apiErrorBody{}))},
+			"text/plain":               map[string]interface{}{"schema": &schema{Type: "string"}},
+		},
+	}
+
+	paths := make(map[string]map[string]interface{})
+	for _, op := range apiOperations {
+		params := make([]interface{}, 0)
+		for _, m := range pathParamPattern.FindAllStringSubmatch(op.Path, -1) {
+			t := "string"
+			if m[1] == "id" || m[1] == "exid" {
+				t = "integer"
+			}
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true, "schema": &schema{Type: t},
+			})
+		}
+		for _, q := range op.Query {
+			params = append(params, map[string]interface{}{
+				"name": q, "in": "query", "schema": &schema{Type: "string"},
+			})
+		}
+
+		response := map[string]interface{}{"description": "OK"}
+		switch {
+		case op.Response != nil:
+			response["content"] = jsonContent(op.Response)
+		case op.ContentType != "":
+			response["content"] = map[string]interface{}{
+				op.ContentType: map[string]interface{}{"schema": &schema{Type: "string", Format: "binary"}},
+			}
+		}
+		operation := map[string]interface{}{
+			"summary":    op.Summary,
+			"parameters": params,
+			"responses":  map[string]interface{}{"200": response, "default": errorResponse},
+		}
+		switch {
+		case op.Request != nil:
+			operation["requestBody"] = map[string]interface{}{"required": true, "content": jsonContent(op.Request)}
+		case op.RequestType != "":
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					op.RequestType: map[string]interface{}{"schema": &schema{Type: "string", Format: "binary"}},
+				},
+			}
+		}
+		if op.Auth {
+			operation["security"] = []interface{}{map[string]interface{}{"bearer": []string{}}}
+		}
+
+		if paths[op.Path] == nil {
+			paths[op.Path] = make(map[string]interface{})
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+
+	messages := func(vs []interface{}) []*schema {
+		schemas := make([]*schema, len(vs))
+		for i, v := range vs {
+			schemas[i] = g.schemaOf(reflect.TypeOf(v))
+		}
+		return schemas
+	}
+	events := make(map[string]*schema)
+	for name, v := range eventTypes {
+		events[string(name)] = g.schemaOf(reflect.TypeOf(v))
+	}
+	paths["/v1/ws/updates"] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"summary":   "WebSocket of server events. Each message is an event, whose data depends on its type",
+			"responses": map[string]interface{}{"101": map[string]interface{}{"description": "Switching Protocols"}},
+			"x-websocket-messages": map[string]interface{}{
+				"receive":     messages(updatesMessages),
+				"event-types": events,
+			},
+		},
+	}
+	paths["/v1/ws/streamstatus"] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"summary":     "WebSocket for ingest nodes to report heartbeats and stream status",
+			"description": "Nodes authenticate with the token given when they were registered, or a client certificate whose common name is the node's name",
+			"responses": map[string]interface{}{
+				"101": map[string]interface{}{"description": "Switching Protocols"},
+				"401": map[string]interface{}{"description": "Missing or invalid node token"},
+			},
+			"x-websocket-messages": map[string]interface{}{
+				"send":    messages(streamStatusMessages),
+				"receive": messages(streamStatusReplies),
+			},
+		},
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "nexus-server",
+			"version": VERSION,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.components,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &openAPIDoc{g, b}, nil
+}
+
+// decodeBody decodes a JSON request body into v, after validating it against
+// the schema of v's type
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	if err != nil {
+		if int64(len(body)) == maxRequestBody { // Stopped at the limit
+			return statusError{
+				http.StatusRequestEntityTooLarge,
+				fmt.Errorf("Request body larger than %d bytes", maxRequestBody),
+			}
+		}
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var raw interface{}
+	if err := dec.Decode(&raw); err != nil {
+		requestLog(r).Debugf("Error decoding JSON: %s", err.Error())
+		return statusError{
+			400,
+			err,
+		}
+	}
+
+	var errs []fieldError
+	apiDoc.gen.validate(raw, apiDoc.gen.schemaOf(reflect.TypeOf(v).Elem()), "", &errs)
+	if len(errs) > 0 {
+		return validationError{errs}
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return statusError{
+			400,
+			err,
+		}
+	}
+	return nil
+}
+
+func openAPIHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/json")
+	_, err := w.Write(apiDoc.json)
+	return err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testItem struct {
+	Name  string `json:"name" openapi:"required,pattern=^[a-z]+$"`
+	Count int    `json:"count" openapi:"min=1"`
+}
+
+type testBody struct {
+	ID     int            `json:"id" openapi:"readonly"`
+	Title  string         `json:"title" openapi:"required"`
+	Kind   string         `json:"kind" openapi:"enum=live|vod"`
+	URL    string         `json:"url" openapi:"format=uri"`
+	When   nullTime       `json:"when"`
+	Every  duration       `json:"every"`
+	Weight float64        `json:"weight" openapi:"min=0.5"`
+	Item   *testItem      `json:"item"`
+	Items  []testItem     `json:"items"`
+	Labels map[string]int `json:"labels"`
+	Hidden string         `json:"-"`
+}
+
+// errorList formats field errors as "field error" lines, for comparison
+func errorList(errs []fieldError) string {
+	lines := make([]string, len(errs))
+	for i, fe := range errs {
+		lines[i] = fe.Field + " " + fe.Error
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestValidate(t *testing.T) {
+	g := &schemaGenerator{components: make(map[string]*schema)}
+	s := g.schemaOf(reflect.TypeOf(testBody{}))
+	if g.err != nil {
+		t.Fatal(g.err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"Valid", `{"title": "t", "kind": "vod", "url": "https://example.com/x", "when": "2030-01-01T18:00:00Z",
+			"every": "5m", "weight": 0.5, "item": {"name": "a", "count": 1}, "items": [], "labels": {"a": 1}}`, nil},
+		{"Only required", `{"title": ""}`, nil},
+		{"Nulls", `{"title": "t", "when": null, "item": null}`, nil},
+		{"Missing required", `{}`, []string{"title is required"}},
+		{"Not an object", `[]`, []string{"body must be an object"}},
+		{"Readonly ignored", `{"title": "t", "id": "not even a number"}`, nil},
+		{"Unknown field", `{"title": "t", "extra": 1, "Hidden": "x"}`, []string{"Hidden is not a known field", "extra is not a known field"}},
+		{"Wrong types", `{"title": 1, "weight": "heavy", "items": {}, "labels": []}`, []string{
+			"items must be an array", "labels must be an object", "title must be a string", "weight must be a number",
+		}},
+		{"Null string", `{"title": null}`, []string{"title must not be null"}},
+		{"Enum", `{"title": "t", "kind": "radio"}`, []string{"kind must be one of live, vod"}},
+		{"Formats", `{"title": "t", "url": "/relative", "when": "tomorrow", "every": "often"}`, []string{
+			"every must be a duration such as 30s or 5m", "url must be an absolute URI", "when must be an RFC 3339 date-time",
+		}},
+		{"Minimum", `{"title": "t", "weight": 0.25}`, []string{"weight must be at least 0.5"}},
+		{"Nested", `{"title": "t", "item": {"name": "Upper", "count": 0, "extra": true}}`, []string{
+			"item.count must be at least 1", "item.extra is not a known field", "item.name must match ^[a-z]+$",
+		}},
+		{"Nested in array", `{"title": "t", "items": [{"name": "ok"}, {"count": 1.5}]}`, []string{
+			"items[1].name is required", "items[1].count must be a integer",
+		}},
+		{"Map values", `{"title": "t", "labels": {"a": "b"}}`, []string{"labels.a must be a integer"}},
+	}
+	for _, test := range tests {
+		dec := json.NewDecoder(strings.NewReader(test.body))
+		dec.UseNumber()
+		var raw interface{}
+		if err := dec.Decode(&raw); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		var errs []fieldError
+		g.validate(raw, s, "", &errs)
+		if got, want := errorList(errs), strings.Join(test.want, "\n"); got != want {
+			t.Errorf("%s: errors\n%s\nwant\n%s", test.name, got, want)
+		}
+	}
+}
+
+func TestInvalidTags(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+	}{
+		{"Bad pattern", struct {
+			A string `json:"a" openapi:"pattern=("`
+		}{}},
+		{"Bad min", struct {
+			A int `json:"a" openapi:"min=one"`
+		}{}},
+		{"Missing value", struct {
+			A string `json:"a" openapi:"required,pattern"`
+		}{}},
+		{"Unknown option", struct {
+			A string `json:"a" openapi:"requird"`
+		}{}},
+	}
+	for _, test := range tests {
+		g := &schemaGenerator{components: make(map[string]*schema)}
+		g.schemaOf(reflect.TypeOf(test.v))
+		if g.err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+
+	if _, err := buildOpenAPI(); err != nil {
+		t.Errorf("OpenAPI document has invalid tags: %s", err)
+	}
+}
+
+func TestDecodeBodySize(t *testing.T) {
+	if err := loadOpenAPI(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		size int
+		code int
+	}{
+		{maxRequestBody, http.StatusBadRequest}, // Read, then rejected as the wrong type
+		{maxRequestBody + 1, http.StatusRequestEntityTooLarge},
+		{2 * maxRequestBody, http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		body := `"` + strings.Repeat("a", test.size-2) + `"`
+		r := httptest.NewRequest("POST", "/v1/api/streams", bytes.NewReader([]byte(body)))
+		var s stream
+		err := decodeBody(httptest.NewRecorder(), r, &s)
+		code := 0
+		if ae, ok := err.(appError); ok {
+			code = ae.Status()
+		}
+		if code != test.code {
+			t.Errorf("Body of %d bytes got %v, want status %d", test.size, err, test.code)
+		}
+	}
+}
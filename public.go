@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultPublicMaxAge = 30 * time.Second
+
+const publicStreamSQL = streamSQL + `WHERE is_public `
+
+// publicStream is the view of a stream given to anyone, without its key or
+// the resources it books
+type publicStream struct {
+	ID          int         `json:"id"`
+	DisplayName string      `json:"display_name"`
+	StartAt     nullTime    `json:"start_at"`
+	EndAt       nullTime    `json:"end_at"`
+	StreamName  string      `json:"stream_name"`
+	RRule       string      `json:"rrule"`
+	Timezone    string      `json:"timezone"`
+	Description string      `json:"description"`
+	Tags        stringList  `json:"tags"`
+	Category    string      `json:"category"`
+	PosterURL   string      `json:"poster_url"`
+	Links       linkList    `json:"links"`
+	ChannelID   int         `json:"channel_id"`
+	State       streamState `json:"state"`
+}
+
+type publicProgramme struct {
+	Stream     *publicStream `json:"stream"`
+	Occurrence *occurrence   `json:"occurrence"`
+	Live       bool          `json:"live"`
+}
+
+func toPublicStream(s stream) *publicStream {
+	return &publicStream{
+		ID:          s.ID,
+		DisplayName: s.DisplayName,
+		StartAt:     s.StartAt,
+		EndAt:       s.EndAt,
+		StreamName:  s.StreamName,
+		RRule:       s.RRule,
+		Timezone:    s.Timezone,
+		Description: s.Description,
+		Tags:        s.Tags,
+		Category:    s.Category,
+		PosterURL:   s.PosterURL,
+		Links:       s.Links,
+		ChannelID:   s.ChannelID,
+		State:       s.State,
+	}
+}
+
+func toPublicStreams(streams []stream) []*publicStream {
+	result := make([]*publicStream, len(streams))
+	for i, s := range streams {
+		result[i] = toPublicStream(s)
+	}
+	return result
+}
+
+func toPublicProgramme(p *programme) *publicProgramme {
+	if p == nil {
+		return nil
+	}
+	return &publicProgramme{toPublicStream(p.Stream), p.Occurrence, p.Live}
+}
+
+// publicMaxAge returns how long clients and proxies may cache public responses
+func (e *env) publicMaxAge() time.Duration {
+	if e.conf.Public.MaxAge.Duration <= 0 {
+		return defaultPublicMaxAge
+	}
+	return e.conf.Public.MaxAge.Duration
+}
+
+// etagMatches returns true if an If-None-Match header matches etag
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCached writes v as cacheable JSON, with an ETag of its content. A
+// request whose If-None-Match matches gets a 304 instead.
+func (e *env) writeCached(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	body = append(body, '\n')
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(body))
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(e.publicMaxAge().Seconds())))
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(body)
+	return err
+}
+
+// publicStreamByID fetches a public stream, given the id from a request URL.
+// Private streams are reported as not found.
+func (e *env) publicStreamByID(r *http.Request, id string) (stream, error) {
+	s, err := e.streamByID(r, id)
+	if err == nil && !s.IsPublic {
+		return s, statusError{
+			404,
+			errors.New("Stream not found"),
+		}
+	}
+	return s, err
+}
+
+// Lists public streams, optionally filtered by "tag" and "category" query parameters
+func publicStreamsHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	streams := make([]stream, 0)
+	if err := e.db.Select(&streams, publicStreamSQL); err != nil {
+		requestLog(r).Errorf("Error querying for stream(s): %s", err.Error())
+		return err
+	}
+	return e.writeCached(w, r, toPublicStreams(filterStreams(r, streams)))
+}
+
+func publicStreamHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	s, err := e.publicStreamByID(r, mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	return e.writeCached(w, r, toPublicStream(s))
+}
+
+func publicSearchHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	results, err := e.searchStreams(r, publicStreamSQL)
+	if err != nil {
+		return err
+	}
+	return e.writeCached(w, r, toPublicStreams(results))
+}
+
+func publicOccurrencesHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	s, err := e.publicStreamByID(r, mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	occs, err := e.requestOccurrences(r, s)
+	if err != nil {
+		return err
+	}
+	return e.writeCached(w, r, occs)
+}
+
+func publicPosterHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	s, err := e.publicStreamByID(r, mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(e.publicMaxAge().Seconds())))
+	return e.servePoster(w, r, s)
+}
+
+func publicChannelsHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	channels := make([]channel, 0)
+	if err := e.db.Select(&channels, channelSQL+`ORDER BY name`); err != nil {
+		requestLog(r).Errorf("Error querying for channels: %s", err.Error())
+		return err
+	}
+	return e.writeCached(w, r, channels)
+}
+
+func publicChannelHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	c, err := e.channelByID(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	return e.writeCached(w, r, c)
+}
+
+// Returns what is on a channel now, considering only public streams
+func publicChannelNowHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	c, err := e.channelByID(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	now, _, err := e.channelProgrammes(c, time.Now(), true)
+	if err != nil {
+		requestLog(r).Errorf("Error finding channel programmes: %s", err.Error())
+		return err
+	}
+	return e.writeCached(w, r, toPublicProgramme(now))
+}
+
+// Returns the next occurrence on a channel, considering only public streams
+func publicChannelNextHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	c, err := e.channelByID(mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	_, next, err := e.channelProgrammes(c, time.Now(), true)
+	if err != nil {
+		requestLog(r).Errorf("Error finding channel programmes: %s", err.Error())
+		return err
+	}
+	return e.writeCached(w, r, toPublicProgramme(next))
+}
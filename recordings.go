@@ -0,0 +1,253 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const recordingSQL = `
+	SELECT
+		id() as id, stream_id, stream_name, session, path, size, duration_ms, recorded_at
+	FROM
+		recordings
+`
+
+// resolvePath makes a path absolute and follows any symlinks in it. If the
+// file doesn't exist, the directory it would be in is resolved instead.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if os.IsNotExist(err) {
+		dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, filepath.Base(abs)), nil
+	}
+	return resolved, err
+}
+
+// resolveRecordingDirs resolves the configured recording directories once, so
+// the absolute paths nginx-rtmp reports can be compared with them. Directories
+// which can't be resolved are left out.
+func resolveRecordingDirs(dirs []string) []string {
+	resolved := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		r, err := resolvePath(dir)
+		if err != nil {
+			recordingsLog.Warnf("Unable to resolve recording directory %s: %s", dir, err.Error())
+			continue
+		}
+		resolved = append(resolved, r)
+	}
+	return resolved
+}
+
+// inRecordingDir returns true if path is inside one of the configured
+// recording directories, once symlinks are followed
+func (e *env) inRecordingDir(path string) bool {
+	path, err := resolvePath(path)
+	if err != nil {
+		return false
+	}
+	for _, dir := range e.recordingDirs {
+		rel, err := filepath.Rel(dir, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle requests originating from nginx-rtmp's on_record_done feature, and add the finished
+// recording to the catalogue.
+func rpcRecordDoneHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	name, path := r.FormValue("name"), r.FormValue("path")
+	if name == "" || path == "" {
+		return statusError{
+			400,
+			errors.New("No stream name or recording path"),
+		}
+	}
+	if !e.inRecordingDir(path) {
+		requestLog(r).Warnf("Recording %s is outside the configured recording directories, and can't be downloaded", path)
+	}
+
+	rec := recording{
+		StreamName: name,
+		Session:    r.FormValue("clientid"),
+		Path:       path,
+		RecordedAt: toNullTime(time.Now()),
+	}
+
+	err := e.db.Get(&rec.StreamID, `SELECT id() FROM streams WHERE stream_name = $1`, name)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		requestLog(r).Warnf("Unable to stat recording %s: %s", path, err.Error())
+	} else {
+		rec.Size = info.Size()
+		d, err := flvDuration(path)
+		if err != nil {
+			requestLog(r).Warnf("Unable to find duration of recording %s: %s", path, err.Error())
+		}
+		rec.DurationMS = int64(d / time.Millisecond)
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO recordings (
+			stream_id, stream_name, session, path, size, duration_ms, recorded_at
+		) VALUES (
+			$1, $2, $3, $4, $5, $6, $7
+		)`,
+		int64(rec.StreamID), rec.StreamName, rec.Session, rec.Path, rec.Size, rec.DurationMS, rec.RecordedAt,
+	)
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	requestLog(r).Infof("Recorded %s to %s (%d bytes)", name, path, rec.Size)
+	return nil
+}
+
+func getStreamRecordingsHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	s, err := e.streamByID(r, mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+
+	recordings := make([]recording, 0)
+	err = e.db.Select(&recordings, recordingSQL+`WHERE stream_id = $1 ORDER BY recorded_at DESC`, int64(s.ID))
+	if err != nil {
+		requestLog(r).Errorf("Error querying for recordings: %s", err.Error())
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(recordings); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// Serves a recording file. Range requests are supported so players can seek.
+func downloadRecordingHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return statusError{
+			400,
+			errors.New("Non-numeric ID in URL"),
+		}
+	}
+
+	var rec recording
+	err = e.db.Get(&rec, recordingSQL+`WHERE id() = $1`, int64(id))
+	if err == sql.ErrNoRows {
+		return statusError{
+			404,
+			err,
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if !e.inRecordingDir(rec.Path) {
+		return statusError{
+			403,
+			errors.New("Recording is outside the configured recording directories"),
+		}
+	}
+	f, err := os.Open(rec.Path)
+	if os.IsNotExist(err) {
+		return statusError{
+			404,
+			errors.New("Recording file no longer exists"),
+		}
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	requestLog(r).Infof("%s downloading recording %d", actorFromRequest(r), rec.ID)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filepath.Base(rec.Path)+`"`)
+	http.ServeContent(w, r, filepath.Base(rec.Path), info.ModTime(), f)
+	return nil
+}
+
+// pruneRecordings periodically removes recordings older than the retention
+// period from the catalogue, and optionally deletes their files
+func (e *env) pruneRecordings() {
+	retention := e.conf.Recordings.Retention.Duration
+	if retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := e.pruneRecordingsBefore(time.Now().Add(-retention)); err != nil {
+			recordingsLog.Errorf("Error pruning recordings: %s", err.Error())
+		}
+		<-ticker.C
+	}
+}
+
+func (e *env) pruneRecordingsBefore(cutoff time.Time) error {
+	old := make([]recording, 0)
+	if err := e.db.Select(&old, recordingSQL+`WHERE recorded_at < $1`, cutoff); err != nil {
+		return err
+	}
+
+	for _, rec := range old {
+		if e.conf.Recordings.DeleteFiles && e.inRecordingDir(rec.Path) {
+			if err := os.Remove(rec.Path); err != nil && !os.IsNotExist(err) {
+				recordingsLog.Warnf("Unable to delete recording %s: %s", rec.Path, err.Error())
+				continue // Keep it in the catalogue, so we try again next time
+			}
+		}
+
+		tx, err := e.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM recordings WHERE id() = $1`, int64(rec.ID)); err != nil {
+			if rerr := tx.Rollback(); rerr != nil {
+				return rerr
+			}
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		recordingsLog.Infof("Pruned recording %s", rec.Path)
+	}
+	return nil
+}
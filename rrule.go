@@ -0,0 +1,433 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maximum number of periods to step through when expanding a recurrence, so
+// a sparse rule can't keep us busy forever
+const maxRecurrencePeriods = 50000
+
+var rruleWeekdays = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// weekdayNum is an entry of BYDAY, such as MO, 2TU or -1FR
+type weekdayNum struct {
+	n   int // Ordinal within the month. Zero for every such weekday
+	day time.Weekday
+}
+
+// recurrence is a parsed RFC 5545 RRULE. Supported are FREQ (DAILY, WEEKLY,
+// MONTHLY or YEARLY), INTERVAL, COUNT, UNTIL, BYDAY and BYMONTHDAY. Weeks
+// always start on Monday.
+type recurrence struct {
+	freq       string
+	interval   int
+	count      int
+	until      time.Time
+	byDay      []weekdayNum
+	byMonthDay []int
+}
+
+// parseRRule parses a recurrence rule. Dates in UNTIL without a "Z" suffix are
+// taken to be in loc.
+func parseRRule(rule string, loc *time.Location) (*recurrence, error) {
+	rec := &recurrence{interval: 1}
+	rule = strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:")
+	for _, part := range strings.Split(rule, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid RRULE part: %q", part)
+		}
+		key, value := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+
+		var err error
+		switch key {
+		case "FREQ":
+			switch value {
+			case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+				rec.freq = value
+			default:
+				return nil, fmt.Errorf("Unsupported RRULE frequency: %s", value)
+			}
+		case "INTERVAL":
+			rec.interval, err = strconv.Atoi(value)
+			if err == nil && rec.interval < 1 {
+				err = errors.New("must be positive")
+			}
+		case "COUNT":
+			rec.count, err = strconv.Atoi(value)
+			if err == nil && rec.count < 1 {
+				err = errors.New("must be positive")
+			}
+		case "UNTIL":
+			rec.until, err = parseRRuleTime(value, loc)
+		case "BYDAY":
+			for _, d := range strings.Split(value, ",") {
+				var wn weekdayNum
+				if len(d) < 2 {
+					return nil, fmt.Errorf("Invalid RRULE BYDAY: %q", d)
+				}
+				day, ok := rruleWeekdays[d[len(d)-2:]]
+				if !ok {
+					return nil, fmt.Errorf("Invalid RRULE BYDAY: %q", d)
+				}
+				wn.day = day
+				if n := d[:len(d)-2]; n != "" {
+					if wn.n, err = strconv.Atoi(n); err != nil || wn.n == 0 || wn.n < -5 || wn.n > 5 {
+						return nil, fmt.Errorf("Invalid RRULE BYDAY: %q", d)
+					}
+				}
+				rec.byDay = append(rec.byDay, wn)
+			}
+		case "BYMONTHDAY":
+			for _, d := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(d)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return nil, fmt.Errorf("Invalid RRULE BYMONTHDAY: %q", d)
+				}
+				rec.byMonthDay = append(rec.byMonthDay, n)
+			}
+		case "WKST":
+			if value != "MO" {
+				return nil, errors.New("Only WKST=MO is supported")
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported RRULE part: %s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid RRULE %s: %s", key, err.Error())
+		}
+	}
+
+	if rec.freq == "" {
+		return nil, errors.New("RRULE has no FREQ")
+	}
+	if rec.count > 0 && !rec.until.IsZero() {
+		return nil, errors.New("RRULE can't have both COUNT and UNTIL")
+	}
+	for _, wn := range rec.byDay {
+		if wn.n != 0 && rec.freq != "MONTHLY" {
+			return nil, errors.New("RRULE BYDAY ordinals are only supported with FREQ=MONTHLY")
+		}
+	}
+	if len(rec.byMonthDay) > 0 && rec.freq != "MONTHLY" {
+		return nil, errors.New("RRULE BYMONTHDAY is only supported with FREQ=MONTHLY")
+	}
+	return rec, nil
+}
+
+func parseRRuleTime(value string, loc *time.Location) (time.Time, error) {
+	if strings.HasSuffix(value, "Z") {
+		return time.Parse("20060102T150405Z", value)
+	}
+	if len(value) == 8 {
+		t, err := time.ParseInLocation("20060102", value, loc)
+		// A date-only UNTIL includes the whole of that day
+		return t.AddDate(0, 0, 1).Add(-time.Second), err
+	}
+	return time.ParseInLocation("20060102T150405", value, loc)
+}
+
+// at returns the given date at the wall clock time of dtstart, in its
+// location. Working in wall clock time keeps occurrences at the same local
+// time either side of a DST change.
+func at(dtstart time.Time, year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, dtstart.Hour(), dtstart.Minute(), dtstart.Second(), 0, dtstart.Location())
+}
+
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// period returns the candidate occurrences in the k-th period after dtstart,
+// in no particular order. Candidates may be before dtstart.
+func (rec *recurrence) period(dtstart time.Time, k int) []time.Time {
+	y, m, d := dtstart.Date()
+	step := k * rec.interval
+	candidates := make([]time.Time, 0)
+
+	switch rec.freq {
+	case "DAILY":
+		t := at(dtstart, y, m, d+step)
+		if rec.matchesDay(t) {
+			candidates = append(candidates, t)
+		}
+
+	case "WEEKLY":
+		monday := d - (int(dtstart.Weekday())+6)%7 + 7*step
+		days := rec.byDay
+		if len(days) == 0 {
+			days = []weekdayNum{{0, dtstart.Weekday()}}
+		}
+		for _, wn := range days {
+			candidates = append(candidates, at(dtstart, y, m, monday+(int(wn.day)+6)%7))
+		}
+
+	case "MONTHLY":
+		first := time.Date(y, m+time.Month(step), 1, 0, 0, 0, 0, time.UTC)
+		y, m := first.Year(), first.Month()
+		n := daysIn(y, m)
+		switch {
+		case len(rec.byMonthDay) > 0:
+			for _, md := range rec.byMonthDay {
+				if md < 0 {
+					md = n + md + 1
+				}
+				if md >= 1 && md <= n {
+					candidates = append(candidates, at(dtstart, y, m, md))
+				}
+			}
+		case len(rec.byDay) > 0:
+			offset := int(first.Weekday())
+			for _, wn := range rec.byDay {
+				firstDay := 1 + (int(wn.day)-offset+7)%7
+				all := make([]int, 0, 5)
+				for day := firstDay; day <= n; day += 7 {
+					all = append(all, day)
+				}
+				switch {
+				case wn.n == 0:
+					for _, day := range all {
+						candidates = append(candidates, at(dtstart, y, m, day))
+					}
+				case wn.n > 0 && wn.n <= len(all):
+					candidates = append(candidates, at(dtstart, y, m, all[wn.n-1]))
+				case wn.n < 0 && -wn.n <= len(all):
+					candidates = append(candidates, at(dtstart, y, m, all[len(all)+wn.n]))
+				}
+			}
+		default:
+			if d <= n { // Months without this day are skipped, as per RFC 5545
+				candidates = append(candidates, at(dtstart, y, m, d))
+			}
+		}
+
+	case "YEARLY":
+		if d <= daysIn(y+step, m) {
+			candidates = append(candidates, at(dtstart, y+step, m, d))
+		}
+	}
+	return candidates
+}
+
+// matchesDay applies BYDAY as a filter, for frequencies where it limits
+// rather than expands the set of occurrences
+func (rec *recurrence) matchesDay(t time.Time) bool {
+	if len(rec.byDay) == 0 {
+		return true
+	}
+	for _, wn := range rec.byDay {
+		if t.Weekday() == wn.day {
+			return true
+		}
+	}
+	return false
+}
+
+// expand returns the start times of all occurrences starting in [from, to).
+// dtstart should be in the location the rule is to be evaluated in, and
+// nothing before it is ever returned.
+func (rec *recurrence) expand(dtstart, from, to time.Time) []time.Time {
+	starts := make([]time.Time, 0)
+	n := 0
+	for k := 0; k < maxRecurrencePeriods; k++ {
+		candidates := rec.period(dtstart, k)
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+		for _, t := range candidates {
+			if t.Before(dtstart) {
+				continue
+			}
+			if !rec.until.IsZero() && t.After(rec.until) || !t.Before(to) {
+				return starts
+			}
+			n++
+			if rec.count > 0 && n > rec.count {
+				return starts
+			}
+			if !t.Before(from) {
+				starts = append(starts, t)
+			}
+		}
+	}
+	return starts
+}
+
+// occurrence is a single instance of a scheduled stream
+type occurrence struct {
+	Start     time.Time  `json:"start_at"`
+	End       *time.Time `json:"end_at"`
+	Original  time.Time  `json:"original_start_at"` // Start according to the schedule, before any exception
+	Cancelled bool       `json:"cancelled"`
+	Moved     bool       `json:"moved"`
+}
+
+// location returns the time zone a stream's schedule is in
+func (s *stream) location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(s.Timezone)
+}
+
+// validateSchedule checks a stream's start and end times, time zone and
+// recurrence rule
+func (s *stream) validateSchedule() error {
+	loc, err := s.location()
+	if err != nil {
+		return fmt.Errorf("Invalid timezone: %s", s.Timezone)
+	}
+	if s.StartAt.Valid && s.EndAt.Valid && !s.EndAt.Time.After(s.StartAt.Time) {
+		return errors.New("end_at must be after start_at")
+	}
+	if s.RRule != "" {
+		if !s.StartAt.Valid {
+			return errors.New("A recurring stream needs a start_at")
+		}
+		if _, err := parseRRule(s.RRule, loc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// occurrences returns the occurrences of a stream which overlap [from, to),
+// with exceptions applied. Cancelled occurrences are included, but flagged.
+func (s *stream) occurrences(from, to time.Time, exceptions []streamException) ([]occurrence, error) {
+	if !s.StartAt.Valid {
+		return []occurrence{}, nil
+	}
+	loc, err := s.location()
+	if err != nil {
+		return nil, err
+	}
+	var length time.Duration
+	if s.EndAt.Valid {
+		length = s.EndAt.Time.Sub(s.StartAt.Time)
+	}
+
+	dtstart := s.StartAt.Time.In(loc)
+	starts := []time.Time{dtstart}
+	if s.RRule != "" {
+		rec, err := parseRRule(s.RRule, loc)
+		if err != nil {
+			return nil, err
+		}
+		// Start early enough to catch occurrences which are still running at from
+		starts = rec.expand(dtstart, from.Add(-length), to)
+	}
+
+	byOriginal := make(map[int64]*streamException)
+	for i := range exceptions {
+		byOriginal[exceptions[i].Occurrence.Unix()] = &exceptions[i]
+	}
+
+	occs := make([]occurrence, 0, len(starts))
+	add := func(o occurrence) {
+		switch {
+		case o.End != nil:
+			if o.End.After(from) && o.Start.Before(to) {
+				occs = append(occs, o)
+			}
+		case s.RRule == "": // A one-off stream without an end runs indefinitely
+			if o.Start.Before(to) {
+				occs = append(occs, o)
+			}
+		default:
+			if !o.Start.Before(from) && o.Start.Before(to) {
+				occs = append(occs, o)
+			}
+		}
+	}
+	seen := make(map[int64]bool)
+	for _, start := range starts {
+		o := occurrence{Start: start, Original: start}
+		if s.EndAt.Valid {
+			end := start.Add(length)
+			o.End = &end
+		}
+		if ex, ok := byOriginal[start.Unix()]; ok {
+			seen[start.Unix()] = true
+			ex.apply(&o, length)
+		}
+		add(o)
+	}
+
+	// Occurrences may have been moved into the range from outside it
+	for i := range exceptions {
+		ex := &exceptions[i]
+		if seen[ex.Occurrence.Unix()] || ex.Cancelled || !ex.StartAt.Valid {
+			continue
+		}
+		o := occurrence{Original: ex.Occurrence.In(loc)}
+		if s.EndAt.Valid {
+			end := o.Original.Add(length)
+			o.End = &end
+		}
+		ex.apply(&o, length)
+		add(o)
+	}
+
+	sort.Slice(occs, func(i, j int) bool { return occs[i].Start.Before(occs[j].Start) })
+	return occs, nil
+}
+
+// currentOccurrence returns the occurrence of a stream which is running at t,
+// or failing that the next one to start. Occurrences are treated as running
+// until overrun after their end. Cancelled occurrences are skipped.
+func (s *stream) currentOccurrence(t time.Time, overrun time.Duration, exceptions []streamException) (occurrence, bool, error) {
+	// Look ahead far enough to find the next occurrence of even a yearly stream
+	occs, err := s.occurrences(t.Add(-overrun), t.AddDate(1, 0, 1), exceptions)
+	if err != nil {
+		return occurrence{}, false, err
+	}
+	for _, o := range occs {
+		if o.Cancelled {
+			continue
+		}
+		if o.End == nil || o.End.Add(overrun).After(t) {
+			return o, true, nil
+		}
+	}
+	return occurrence{}, false, nil
+}
+
+// inWindow returns true if t is within an occurrence, widened by lead and
+// overrun. Occurrences without an end are open-ended.
+func (o *occurrence) inWindow(t time.Time, lead, overrun time.Duration) bool {
+	if t.Before(o.Start.Add(-lead)) {
+		return false
+	}
+	return o.End == nil || t.Before(o.End.Add(overrun))
+}
+
+// apply moves or cancels an occurrence according to an exception
+func (ex *streamException) apply(o *occurrence, length time.Duration) {
+	if ex.Cancelled {
+		o.Cancelled = true
+		return
+	}
+	if ex.StartAt.Valid {
+		o.Start = ex.StartAt.Time
+		o.Moved = true
+		if o.End != nil || ex.EndAt.Valid {
+			end := o.Start.Add(length)
+			if ex.EndAt.Valid {
+				end = ex.EndAt.Time
+			}
+			o.End = &end
+		}
+	}
+}
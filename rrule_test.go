@@ -0,0 +1,305 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// mustTime parses a time to the minute, as local time in loc if it has no
+// offset
+func mustTime(t *testing.T, s string, loc *time.Location) time.Time {
+	tm, err := time.ParseInLocation("2006-01-02T15:04", s, loc)
+	if err != nil {
+		if tm, err = time.Parse("2006-01-02T15:04Z07:00", s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tm
+}
+
+func testStream(t *testing.T, start, end, rrule, tz string) stream {
+	s := stream{RRule: rrule, Timezone: tz}
+	loc, err := s.location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.StartAt = toNullTime(mustTime(t, start, loc))
+	if end != "" {
+		s.EndAt = toNullTime(mustTime(t, end, loc))
+	}
+	return s
+}
+
+// starts formats the start of each occurrence as local time in loc
+func starts(occs []occurrence, loc *time.Location) string {
+	times := make([]string, len(occs))
+	for i, o := range occs {
+		times[i] = o.Start.In(loc).Format("2006-01-02T15:04")
+	}
+	return strings.Join(times, " ")
+}
+
+func TestRRuleExpansion(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    string // Local time in tz
+		rrule    string
+		tz       string
+		from, to string // Local time in tz
+		want     string // Local starts in tz
+	}{
+		{
+			name:  "weekly across the start of DST stays at the same local time",
+			start: "2026-03-20T18:00", rrule: "FREQ=WEEKLY;COUNT=3", tz: "Europe/London",
+			from: "2026-03-01T00:00", to: "2027-01-01T00:00",
+			want: "2026-03-20T18:00 2026-03-27T18:00 2026-04-03T18:00",
+		},
+		{
+			name:  "daily across the end of DST",
+			start: "2026-10-24T09:00", rrule: "FREQ=DAILY;COUNT=3", tz: "America/New_York",
+			from: "2026-10-01T00:00", to: "2027-01-01T00:00",
+			want: "2026-10-24T09:00 2026-10-25T09:00 2026-10-26T09:00",
+		},
+		{
+			name:  "last Friday of the month",
+			start: "2026-01-30T19:00", rrule: "FREQ=MONTHLY;BYDAY=-1FR;COUNT=4",
+			from: "2026-01-01T00:00", to: "2027-01-01T00:00",
+			want: "2026-01-30T19:00 2026-02-27T19:00 2026-03-27T19:00 2026-04-24T19:00",
+		},
+		{
+			name:  "second Tuesday of the month",
+			start: "2026-01-13T19:00", rrule: "FREQ=MONTHLY;BYDAY=2TU;COUNT=3",
+			from: "2026-01-01T00:00", to: "2027-01-01T00:00",
+			want: "2026-01-13T19:00 2026-02-10T19:00 2026-03-10T19:00",
+		},
+		{
+			name:  "monthly on the 31st skips shorter months",
+			start: "2026-01-31T12:00", rrule: "FREQ=MONTHLY;COUNT=4",
+			from: "2026-01-01T00:00", to: "2027-01-01T00:00",
+			want: "2026-01-31T12:00 2026-03-31T12:00 2026-05-31T12:00 2026-07-31T12:00",
+		},
+		{
+			name:  "BYMONTHDAY=31 skips shorter months",
+			start: "2026-01-31T12:00", rrule: "FREQ=MONTHLY;BYMONTHDAY=31;COUNT=3",
+			from: "2026-01-01T00:00", to: "2027-01-01T00:00",
+			want: "2026-01-31T12:00 2026-03-31T12:00 2026-05-31T12:00",
+		},
+		{
+			name:  "BYMONTHDAY=-1 is the last day of each month",
+			start: "2026-01-31T12:00", rrule: "FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=4",
+			from: "2026-01-01T00:00", to: "2027-01-01T00:00",
+			want: "2026-01-31T12:00 2026-02-28T12:00 2026-03-31T12:00 2026-04-30T12:00",
+		},
+		{
+			name:  "fortnightly on two days",
+			start: "2026-01-05T20:00", rrule: "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;COUNT=5",
+			from: "2026-01-01T00:00", to: "2027-01-01T00:00",
+			want: "2026-01-05T20:00 2026-01-07T20:00 2026-01-19T20:00 2026-01-21T20:00 2026-02-02T20:00",
+		},
+		{
+			name:  "weekdays only",
+			start: "2026-01-01T08:00", rrule: "FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR;COUNT=4",
+			from: "2026-01-01T00:00", to: "2027-01-01T00:00",
+			want: "2026-01-01T08:00 2026-01-02T08:00 2026-01-05T08:00 2026-01-06T08:00",
+		},
+		{
+			name:  "UNTIL in local time is inclusive",
+			start: "2026-01-01T10:00", rrule: "FREQ=DAILY;UNTIL=20260103T100000", tz: "Europe/Paris",
+			from: "2026-01-01T00:00", to: "2027-01-01T00:00",
+			want: "2026-01-01T10:00 2026-01-02T10:00 2026-01-03T10:00",
+		},
+		{
+			name:  "UNTIL in UTC",
+			start: "2026-01-01T10:00", rrule: "FREQ=DAILY;UNTIL=20260103T085959Z", tz: "Europe/Paris",
+			from: "2026-01-01T00:00", to: "2027-01-01T00:00",
+			want: "2026-01-01T10:00 2026-01-02T10:00",
+		},
+		{
+			name:  "UNTIL as a date includes that day",
+			start: "2026-01-01T22:00", rrule: "FREQ=DAILY;UNTIL=20260102",
+			from: "2026-01-01T00:00", to: "2027-01-01T00:00",
+			want: "2026-01-01T22:00 2026-01-02T22:00",
+		},
+		{
+			name:  "COUNT includes occurrences before the range",
+			start: "2026-01-01T10:00", rrule: "FREQ=DAILY;COUNT=5",
+			from: "2026-01-03T00:00", to: "2027-01-01T00:00",
+			want: "2026-01-03T10:00 2026-01-04T10:00 2026-01-05T10:00",
+		},
+		{
+			name:  "yearly on 29 February skips other years",
+			start: "2024-02-29T12:00", rrule: "FREQ=YEARLY",
+			from: "2024-01-01T00:00", to: "2033-01-01T00:00",
+			want: "2024-02-29T12:00 2028-02-29T12:00 2032-02-29T12:00",
+		},
+		{
+			name:  "range ends before an occurrence starts",
+			start: "2026-01-01T10:00", rrule: "FREQ=WEEKLY",
+			from: "2026-01-01T00:00", to: "2026-01-15T10:00",
+			want: "2026-01-01T10:00 2026-01-08T10:00",
+		},
+	}
+
+	for _, tt := range tests {
+		s := testStream(t, tt.start, "", tt.rrule, tt.tz)
+		loc, _ := s.location()
+		occs, err := s.occurrences(mustTime(t, tt.from, loc), mustTime(t, tt.to, loc), nil)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if got := starts(occs, loc); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRRuleDSTOffsets(t *testing.T) {
+	s := testStream(t, "2026-03-20T18:00", "2026-03-20T19:00", "FREQ=WEEKLY;COUNT=3", "Europe/London")
+	occs, err := s.occurrences(mustTime(t, "2026-03-01T00:00Z", time.UTC), mustTime(t, "2026-05-01T00:00Z", time.UTC), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 18:00 is 18:00 UTC before the clocks change, and 17:00 UTC after
+	want := []string{"2026-03-20T18:00:00Z", "2026-03-27T18:00:00Z", "2026-04-03T17:00:00Z"}
+	if len(occs) != len(want) {
+		t.Fatalf("Got %d occurrences, want %d", len(occs), len(want))
+	}
+	for i, o := range occs {
+		if got := o.Start.UTC().Format(time.RFC3339); got != want[i] {
+			t.Errorf("Occurrence %d starts %s, want %s", i, got, want[i])
+		}
+		if o.End == nil || o.End.Sub(o.Start) != time.Hour {
+			t.Errorf("Occurrence %d ends %v", i, o.End)
+		}
+	}
+}
+
+func TestParseRRuleErrors(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"COUNT=3",
+		"FREQ=HOURLY",
+		"FREQ=DAILY;COUNT=3;UNTIL=20260101T000000Z",
+		"FREQ=DAILY;COUNT=0",
+		"FREQ=DAILY;INTERVAL=-1",
+		"FREQ=WEEKLY;BYDAY=2MO",
+		"FREQ=MONTHLY;BYDAY=6MO",
+		"FREQ=MONTHLY;BYDAY=XX",
+		"FREQ=MONTHLY;BYMONTHDAY=32",
+		"FREQ=WEEKLY;BYMONTHDAY=1",
+		"FREQ=WEEKLY;WKST=SU",
+		"FREQ=DAILY;BYHOUR=9",
+		"FREQ=DAILY;UNTIL=tomorrow",
+	} {
+		if _, err := parseRRule(rule, time.UTC); err == nil {
+			t.Errorf("%q parsed without error", rule)
+		}
+	}
+}
+
+func TestOccurrenceExceptions(t *testing.T) {
+	s := testStream(t, "2026-01-05T18:00Z", "2026-01-05T19:00Z", "FREQ=WEEKLY;COUNT=5", "")
+	exceptions := []streamException{
+		{Occurrence: mustTime(t, "2026-01-12T18:00Z", time.UTC), Cancelled: true},
+		{ // Moved an hour later, keeping its length
+			Occurrence: mustTime(t, "2026-01-19T18:00Z", time.UTC),
+			StartAt:    toNullTime(mustTime(t, "2026-01-19T19:00Z", time.UTC)),
+		},
+		{ // Moved into the range from outside it, with a new end
+			Occurrence: mustTime(t, "2026-02-02T18:00Z", time.UTC),
+			StartAt:    toNullTime(mustTime(t, "2026-01-27T18:00Z", time.UTC)),
+			EndAt:      toNullTime(mustTime(t, "2026-01-27T20:30Z", time.UTC)),
+		},
+	}
+
+	occs, err := s.occurrences(mustTime(t, "2026-01-01T00:00Z", time.UTC), mustTime(t, "2026-02-01T00:00Z", time.UTC), exceptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		start, end, original string
+		cancelled, moved     bool
+	}{
+		{"2026-01-05T18:00:00Z", "2026-01-05T19:00:00Z", "2026-01-05T18:00:00Z", false, false},
+		{"2026-01-12T18:00:00Z", "2026-01-12T19:00:00Z", "2026-01-12T18:00:00Z", true, false},
+		{"2026-01-19T19:00:00Z", "2026-01-19T20:00:00Z", "2026-01-19T18:00:00Z", false, true},
+		{"2026-01-26T18:00:00Z", "2026-01-26T19:00:00Z", "2026-01-26T18:00:00Z", false, false},
+		{"2026-01-27T18:00:00Z", "2026-01-27T20:30:00Z", "2026-02-02T18:00:00Z", false, true},
+	}
+	if len(occs) != len(want) {
+		t.Fatalf("Got %d occurrences, want %d: %s", len(occs), len(want), starts(occs, time.UTC))
+	}
+	for i, o := range occs {
+		w := want[i]
+		if o.Start.UTC().Format(time.RFC3339) != w.start || o.End == nil || o.End.UTC().Format(time.RFC3339) != w.end ||
+			o.Original.UTC().Format(time.RFC3339) != w.original || o.Cancelled != w.cancelled || o.Moved != w.moved {
+			t.Errorf("Occurrence %d is %s-%v (originally %s, cancelled %t, moved %t), want %+v",
+				i, o.Start.UTC(), o.End, o.Original.UTC(), o.Cancelled, o.Moved, w)
+		}
+	}
+}
+
+func TestCurrentOccurrence(t *testing.T) {
+	s := testStream(t, "2026-01-05T18:00Z", "2026-01-05T19:00Z", "FREQ=WEEKLY", "")
+	exceptions := []streamException{
+		{Occurrence: mustTime(t, "2026-01-12T18:00Z", time.UTC), Cancelled: true},
+		{
+			Occurrence: mustTime(t, "2026-01-19T18:00Z", time.UTC),
+			StartAt:    toNullTime(mustTime(t, "2026-01-20T09:00Z", time.UTC)),
+		},
+	}
+	overrun := 15 * time.Minute
+
+	tests := []struct {
+		at   string
+		want string // Start of the occurrence, or empty for none
+	}{
+		{"2026-01-01T00:00Z", "2026-01-05T18:00:00Z"}, // Before the first
+		{"2026-01-05T18:30Z", "2026-01-05T18:00:00Z"}, // During
+		{"2026-01-05T19:10Z", "2026-01-05T18:00:00Z"}, // Overrunning
+		{"2026-01-05T19:20Z", "2026-01-20T09:00:00Z"}, // Next is cancelled, and the one after moved
+		{"2026-01-20T09:30Z", "2026-01-20T09:00:00Z"}, // During the moved occurrence
+		{"2026-01-20T10:30Z", "2026-01-26T18:00:00Z"},
+	}
+	for _, tt := range tests {
+		o, ok, err := s.currentOccurrence(mustTime(t, tt.at, time.UTC), overrun, exceptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if ok {
+			got = o.Start.UTC().Format(time.RFC3339)
+		}
+		if got != tt.want {
+			t.Errorf("At %s: current occurrence %s, want %s", tt.at, got, tt.want)
+		}
+	}
+
+	// A stream whose schedule has ended has no current occurrence
+	ended := testStream(t, "2026-01-05T18:00Z", "2026-01-05T19:00Z", "FREQ=WEEKLY;COUNT=2", "")
+	if o, ok, _ := ended.currentOccurrence(mustTime(t, "2026-02-01T00:00Z", time.UTC), overrun, nil); ok {
+		t.Errorf("Ended stream has current occurrence %s", o.Start)
+	}
+}
+
+func TestInWindow(t *testing.T) {
+	end := mustTime(t, "2026-01-05T19:00Z", time.UTC)
+	o := occurrence{Start: mustTime(t, "2026-01-05T18:00Z", time.UTC), End: &end}
+	lead, overrun := 10*time.Minute, 15*time.Minute
+	for at, want := range map[string]bool{
+		"2026-01-05T17:45Z": false,
+		"2026-01-05T17:50Z": true,
+		"2026-01-05T19:14Z": true,
+		"2026-01-05T19:15Z": false,
+	} {
+		if got := o.inWindow(mustTime(t, at, time.UTC), lead, overrun); got != want {
+			t.Errorf("inWindow at %s is %t, want %t", at, got, want)
+		}
+	}
+	open := occurrence{Start: o.Start}
+	if !open.inWindow(mustTime(t, "2030-01-01T00:00Z", time.UTC), lead, overrun) {
+		t.Error("Occurrence without an end isn't open-ended")
+	}
+}
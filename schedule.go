@@ -0,0 +1,329 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultOccurrenceRange = 30 * 24 * time.Hour
+
+// streamExceptions returns the exceptions to a stream's recurrence
+func (e *env) streamExceptions(streamID int) ([]streamException, error) {
+	exceptions := make([]streamException, 0)
+	err := e.db.Select(&exceptions, `
+		SELECT
+			id() as id, stream_id, occurrence, cancelled, start_at, end_at
+		FROM
+			stream_exceptions
+		WHERE stream_id = $1
+		ORDER BY occurrence`,
+		int64(streamID),
+	)
+	return exceptions, err
+}
+
+// checkPublishWindow rejects publishing a scheduled stream outside its current
+// or next occurrence, if enabled. Returns true if the publish may go ahead;
+// otherwise a response has already been written.
+func (e *env) checkPublishWindow(w http.ResponseWriter, s stream) (bool, error) {
+	if !e.conf.Schedule.EnforceWindow || !s.StartAt.Valid {
+		return true, nil
+	}
+	exceptions, err := e.streamExceptions(s.ID)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	lead, overrun := e.conf.Schedule.LeadTime.Duration, e.conf.Schedule.Overrun.Duration
+	o, ok, err := s.currentOccurrence(now, overrun, exceptions)
+	if err != nil {
+		return false, err
+	}
+	if !ok || !o.inWindow(now, lead, overrun) {
+		log.Infof("Rejected publish of %s outside its scheduled window", s.StreamName)
+		w.WriteHeader(http.StatusForbidden)
+		return false, nil
+	}
+	return true, nil
+}
+
+func updateStreamHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	existing, err := e.streamByID(r, mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+
+	var s stream
+	if err := decodeBody(w, r, &s); err != nil {
+		return err
+	}
+	if err := s.validateSchedule(); err != nil {
+		return statusError{
+			400,
+			err,
+		}
+	}
+	if err := s.validateResources(); err != nil {
+		return statusError{
+			400,
+			err,
+		}
+	}
+	s.ID, s.KeyHash, s.State, s.StateSince = existing.ID, existing.KeyHash, existing.State, existing.StateSince
+	if err := s.validateMetadata(); err != nil {
+		return statusError{
+			400,
+			err,
+		}
+	}
+	if err := e.checkStreamChannel(&s); err != nil {
+		return err
+	}
+	if err := e.checkConflicts(s); err != nil {
+		return err
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE streams
+		SET
+			display_name = $2, is_public = $3, start_at = $4, end_at = $5,
+			stream_name = $6, rrule = $7, timezone = $8, resources = $9,
+			description = $10, tags = $11, category = $12, poster_url = $13, links = $14, channel_id = $15
+		WHERE id() = $1`,
+		int64(s.ID), s.DisplayName, s.IsPublic, s.StartAt, s.EndAt, s.StreamName, s.RRule, s.Timezone, s.Resources,
+		s.Description, s.Tags, s.Category, s.PosterURL, s.Links, int64(s.ChannelID),
+	)
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// The new schedule may change whether the stream is scheduled
+	e.updateScheduledState(&s, time.Now())
+	if s, err = e.streamByID(r, mux.Vars(r)["id"]); err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(&s); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+	}
+	return nil
+}
+
+// parseTimeParam parses an RFC 3339 query parameter, returning def if it is
+// not given
+func parseTimeParam(r *http.Request, name string, def time.Time) (time.Time, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return def, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return t, statusError{
+			400,
+			errors.New("Invalid " + name + " time, expected RFC 3339"),
+		}
+	}
+	return t, nil
+}
+
+// requestOccurrences expands a stream's schedule into its occurrences between
+// the "from" and "to" query parameters, which default to now and 30 days from
+// now
+func (e *env) requestOccurrences(r *http.Request, s stream) ([]occurrence, error) {
+	from, err := parseTimeParam(r, "from", time.Now())
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseTimeParam(r, "to", from.Add(defaultOccurrenceRange))
+	if err != nil {
+		return nil, err
+	}
+	if !to.After(from) {
+		return nil, statusError{
+			400,
+			errors.New("to must be after from"),
+		}
+	}
+
+	exceptions, err := e.streamExceptions(s.ID)
+	if err != nil {
+		requestLog(r).Errorf("Error querying for stream exceptions: %s", err.Error())
+		return nil, err
+	}
+	return s.occurrences(from, to, exceptions)
+}
+
+func getOccurrencesHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	s, err := e.streamByID(r, mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	occs, err := e.requestOccurrences(r, s)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(occs); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func getExceptionsHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	s, err := e.streamByID(r, mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+	exceptions, err := e.streamExceptions(s.ID)
+	if err != nil {
+		requestLog(r).Errorf("Error querying for stream exceptions: %s", err.Error())
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(exceptions); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// Cancels or moves one occurrence of a recurring stream. The occurrence is identified by its
+// original start time.
+func createExceptionHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	s, err := e.streamByID(r, mux.Vars(r)["id"])
+	if err != nil {
+		return err
+	}
+
+	var ex streamException
+	if err := decodeBody(w, r, &ex); err != nil {
+		return err
+	}
+	if ex.Cancelled == ex.StartAt.Valid {
+		return statusError{
+			400,
+			errors.New("An exception must either cancel the occurrence or give its new start_at"),
+		}
+	}
+	if ex.StartAt.Valid && ex.EndAt.Valid && !ex.EndAt.Time.After(ex.StartAt.Time) {
+		return statusError{
+			400,
+			errors.New("end_at must be after start_at"),
+		}
+	}
+
+	// Check the occurrence is really part of the schedule
+	occs, err := s.occurrences(ex.Occurrence, ex.Occurrence.Add(time.Second), nil)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, o := range occs {
+		if o.Start.Equal(ex.Occurrence) {
+			found = true
+		}
+	}
+	if !found {
+		return statusError{
+			400,
+			errors.New("Stream has no occurrence starting at that time"),
+		}
+	}
+	ex.StreamID = s.ID
+	if err := e.checkExceptionConflicts(s, ex); err != nil {
+		return err
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM stream_exceptions WHERE stream_id = $1 AND occurrence = $2`, int64(s.ID), ex.Occurrence)
+	if err == nil {
+		var result sql.Result
+		result, err = tx.Exec(`
+			INSERT INTO stream_exceptions (
+				stream_id, occurrence, cancelled, start_at, end_at
+			) VALUES (
+				$1, $2, $3, $4, $5
+			)`,
+			int64(s.ID), ex.Occurrence, ex.Cancelled, ex.StartAt, ex.EndAt,
+		)
+		if err == nil {
+			if id, err := result.LastInsertId(); err == nil {
+				ex.ID = int(id)
+			}
+		}
+	}
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(&ex); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+	}
+	return nil
+}
+
+func deleteExceptionHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	s, err := e.streamByID(r, vars["id"])
+	if err != nil {
+		return err
+	}
+	exID, err := strconv.Atoi(vars["exid"])
+	if err != nil {
+		return statusError{
+			400,
+			errors.New("Non-numeric ID in URL"),
+		}
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`DELETE FROM stream_exceptions WHERE id() = $1 AND stream_id = $2`, int64(exID), int64(s.ID))
+	if err != nil {
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return statusError{
+			404,
+			errors.New("Exception not found"),
+		}
+	}
+	return nil
+}
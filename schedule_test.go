@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExceptionConflicts(t *testing.T) {
+	e, cleanup := newTestEnv(t)
+	defer cleanup()
+
+	// Conflicts are only checked from now on, so schedule everything in the future
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 2)
+	at := func(d time.Duration) string {
+		return day.Add(d).Format(time.RFC3339)
+	}
+	daily := createStream(t, e, `{"stream_name": "daily", "display_name": "Daily", "resources": ["camera:a"],
+		"start_at": "`+at(9*time.Hour)+`", "end_at": "`+at(10*time.Hour)+`", "rrule": "FREQ=DAILY"}`)
+	createStream(t, e, `{"stream_name": "match", "display_name": "Match", "resources": ["camera:a"],
+		"start_at": "`+at(38*time.Hour)+`", "end_at": "`+at(40*time.Hour)+`"}`)
+
+	// An existing clash with another occurrence, from before cameras were
+	// exclusive, doesn't stop this one moving
+	createStream(t, e, `{"stream_name": "clash", "display_name": "Clash", "resources": ["camera:a"],
+		"start_at": "`+at(57*time.Hour)+`", "end_at": "`+at(58*time.Hour)+`"}`)
+	e.conf.Schedule.Exclusive = []string{"camera"}
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"Moved onto the match", `"start_at": "` + at(39*time.Hour) + `", "end_at": "` + at(40*time.Hour) + `"`, http.StatusConflict},
+		{"Moved without an end onto the match", `"start_at": "` + at(37*time.Hour+30*time.Minute) + `"`, http.StatusConflict},
+		{"Moved clear of the match", `"start_at": "` + at(41*time.Hour) + `"`, http.StatusOK},
+		{"Cancelled", `"cancelled": true`, http.StatusOK},
+	}
+	url := "/v1/api/streams/" + strconv.Itoa(daily.ID) + "/exceptions"
+	for _, test := range tests {
+		body := `{"occurrence": "` + at(33*time.Hour) + `", ` + test.body + `}`
+		w := route(e, "/v1/api/streams/{id}/exceptions", createExceptionHandler, httptest.NewRequest("POST", url, strings.NewReader(body)))
+		if w.Code != test.code {
+			t.Errorf("%s: got %d, want %d: %s", test.name, w.Code, test.code, w.Body)
+		}
+	}
+}
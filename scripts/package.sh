@@ -10,5 +10,7 @@ for arch in ${arches[@]}; do
         --post-uninstall=scripts/post-uninstall.sh \
         -m "`git for-each-ref --format '%(taggername) %(taggeremail)' refs/tags/$CIRCLE_TAG --count=1`" \
         dist/nexus-server_linux_$arch=/usr/bin  \
-        nexus-server.conf.dist=/etc/nexus-server/nexus-server.conf
+        nexus-server.conf.dist=/etc/nexus-server/nexus-server.conf \
+        nexus-server.service=/usr/lib/nexus-server/scripts/nexus-server.service \
+        nexus-server.socket=/usr/lib/nexus-server/scripts/nexus-server.socket
 done
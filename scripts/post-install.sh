@@ -6,7 +6,9 @@ SCRIPT_DIR=/usr/lib/nexus-server/scripts
 
 function install_systemd {
     cp -f $SCRIPT_DIR/nexus-server.service /lib/systemd/system/nexus-server.service
-    systemctl enable nexus-server
+    cp -f $SCRIPT_DIR/nexus-server.socket /lib/systemd/system/nexus-server.socket
+    systemctl daemon-reload
+    systemctl enable nexus-server.socket nexus-server
 }
 
 id $USER &>/dev/null
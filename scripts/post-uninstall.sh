@@ -1,8 +1,9 @@
 #!/bin/bash
 
 function disable_systemd {
-    systemctl disable nexus-server
+    systemctl disable nexus-server nexus-server.socket
     rm -f /lib/systemd/system/nexus-server.service
+    rm -f /lib/systemd/system/nexus-server.socket
 }
 
 if [[ -f /etc/debian_version ]] && [[ "$1" != "upgrade" ]]; then
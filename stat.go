@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	eventStreamStats eventType = "stream_stats"
+
+	defaultStatInterval = 10 * time.Second
+	maxStatBackoff      = 32 // Maximum number of intervals to skip polling an unreachable node
+)
+
+// streamStatsEvent is sent to the updates hub when a live stream's stats change
+type streamStatsEvent struct {
+	StreamName string       `json:"stream_name"`
+	Node       string       `json:"node"`
+	Stats      *streamStats `json:"stats"`
+}
+
+// rtmpStat is the XML document served by nginx-rtmp's stat module
+type rtmpStat struct {
+	XMLName xml.Name `xml:"rtmp"`
+	Server  struct {
+		Applications []rtmpStatApplication `xml:"application"`
+	} `xml:"server"`
+}
+
+type rtmpStatApplication struct {
+	Name string `xml:"name"`
+	Live struct {
+		Streams  []rtmpStatStream `xml:"stream"`
+		NClients int              `xml:"nclients"`
+	} `xml:"live"`
+}
+
+type rtmpStatStream struct {
+	Name       string           `xml:"name"`
+	Time       int64            `xml:"time"`  // Milliseconds since the stream started
+	BWIn       int64            `xml:"bw_in"` // Bits per second
+	BytesIn    int64            `xml:"bytes_in"`
+	BWOut      int64            `xml:"bw_out"`
+	BytesOut   int64            `xml:"bytes_out"`
+	BWAudio    int64            `xml:"bw_audio"`
+	BWVideo    int64            `xml:"bw_video"`
+	Clients    []rtmpStatClient `xml:"client"`
+	Meta       rtmpStatMeta     `xml:"meta"`
+	NClients   int              `xml:"nclients"`
+	Publishing *struct{}        `xml:"publishing"` // Present only while the stream has a publisher
+	Active     *struct{}        `xml:"active"`
+}
+
+type rtmpStatClient struct {
+	ID         string    `xml:"id"`
+	Address    string    `xml:"address"`
+	Time       int64     `xml:"time"`
+	FlashVer   string    `xml:"flashver"`
+	Dropped    int64     `xml:"dropped"`
+	AVSync     int64     `xml:"avsync"`
+	Timestamp  int64     `xml:"timestamp"`
+	Publishing *struct{} `xml:"publishing"`
+	Active     *struct{} `xml:"active"`
+}
+
+type rtmpStatMeta struct {
+	Video struct {
+		Width     int     `xml:"width"`
+		Height    int     `xml:"height"`
+		FrameRate float64 `xml:"frame_rate"`
+		Codec     string  `xml:"codec"`
+		Profile   string  `xml:"profile"`
+		Level     string  `xml:"level"`
+	} `xml:"video"`
+	Audio struct {
+		Codec      string `xml:"codec"`
+		Profile    string `xml:"profile"`
+		Channels   int    `xml:"channels"`
+		SampleRate int    `xml:"sample_rate"`
+	} `xml:"audio"`
+}
+
+// stats converts a stream's entry in the stat XML to its live stats
+func (s *rtmpStatStream) stats() *streamStats {
+	return &streamStats{
+		BitrateIn:    s.BWIn,
+		BitrateVideo: s.BWVideo,
+		BitrateAudio: s.BWAudio,
+		Clients:      s.NClients,
+		VideoCodec:   s.Meta.Video.Codec,
+		Width:        s.Meta.Video.Width,
+		Height:       s.Meta.Video.Height,
+		FrameRate:    s.Meta.Video.FrameRate,
+		AudioCodec:   s.Meta.Audio.Codec,
+		AudioRate:    s.Meta.Audio.SampleRate,
+		Channels:     s.Meta.Audio.Channels,
+		UpdatedAt:    time.Now(),
+	}
+}
+
+var statClient = &http.Client{Timeout: 5 * time.Second}
+
+// fetchStat fetches and parses the stat XML of a node
+func fetchStat(statURL string) (*rtmpStat, error) {
+	resp, err := statClient.Get(statURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Stat module returned %s", resp.Status)
+	}
+
+	var stat rtmpStat
+	if err := xml.NewDecoder(resp.Body).Decode(&stat); err != nil {
+		return nil, err
+	}
+	return &stat, nil
+}
+
+// statBackoff tracks failed polls of a node, so unreachable nodes are polled
+// less often
+type statBackoff struct {
+	failures int
+	skip     int
+}
+
+// pollStats periodically polls the stat module of every node which has a
+// stat URL, and updates the live stream registry with the results
+func (e *env) pollStats() {
+	interval := e.conf.Stats.Interval.Duration
+	if interval <= 0 {
+		interval = defaultStatInterval
+	}
+	backoff := make(map[string]*statBackoff)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		nodes := make([]node, 0)
+		if err := e.db.Select(&nodes, `SELECT name, rtmp_url, stat_url FROM nodes WHERE stat_url != ""`); err != nil {
+			statsLog.Errorf("Error querying for nodes to poll: %s", err.Error())
+			continue
+		}
+
+		var wg sync.WaitGroup
+		for _, n := range nodes {
+			b, ok := backoff[n.Name]
+			if !ok {
+				b = &statBackoff{}
+				backoff[n.Name] = b
+			}
+			if b.skip > 0 {
+				b.skip--
+				continue
+			}
+
+			wg.Add(1)
+			go func(n node, b *statBackoff) {
+				defer wg.Done()
+				err := e.pollNodeStats(n)
+				e.nodes.setStatError(n.Name, err)
+				if err == nil {
+					if b.failures > 0 {
+						statsLog.Infof("Stat module on %s is reachable again", n.Name)
+					}
+					b.failures, b.skip = 0, 0
+					return
+				}
+				if b.failures == 0 {
+					statsLog.Warnf("Unable to poll stat module on %s: %s", n.Name, err.Error())
+				}
+				b.failures++
+				b.skip = maxStatBackoff
+				if b.failures <= 6 {
+					b.skip = 1<<uint(b.failures-1) - 1
+				}
+			}(n, b)
+		}
+		wg.Wait()
+	}
+}
+
+// pollNodeStats polls a single node, and publishes an event for each stream
+// whose stats have changed. Only streams heartbeats say are live on the node
+// get stats; heartbeats alone decide whether a stream is live.
+func (e *env) pollNodeStats(n node) error {
+	stat, err := fetchStat(n.StatURL)
+	if err != nil {
+		return err
+	}
+
+	app := rtmpApp(n)
+	for _, a := range stat.Server.Applications {
+		if a.Name != app {
+			continue
+		}
+		for _, s := range a.Live.Streams {
+			if s.Publishing == nil {
+				continue // Viewers waiting for a stream which isn't being published
+			}
+			if ls, ok := e.live.get(s.Name); !ok || ls.Node != n.Name {
+				continue
+			}
+			stats := s.stats()
+			if e.live.setStats(s.Name, stats) {
+				e.publishEvent(eventStreamStats, streamStatsEvent{s.Name, n.Name, stats})
+			}
+		}
+	}
+	return nil
+}
+
+func getLiveHandler(e *env, w http.ResponseWriter, r *http.Request) error {
+	if err := json.NewEncoder(w).Encode(e.live.list()); err != nil {
+		requestLog(r).Errorf("Error encoding json: %s", err.Error())
+		return err
+	}
+	return nil
+}
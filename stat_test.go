@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// statServer serves testdata/stat.xml, as a node's stat module would
+func statServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		http.ServeFile(w, r, "testdata/stat.xml")
+	}))
+}
+
+func TestParseStat(t *testing.T) {
+	f, err := os.Open("testdata/stat.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var stat rtmpStat
+	if err := xml.NewDecoder(f).Decode(&stat); err != nil {
+		t.Fatal(err)
+	}
+
+	apps := stat.Server.Applications
+	if len(apps) != 2 || apps[0].Name != "live" || apps[1].Name != "archive" {
+		t.Fatalf("Applications are %+v", apps)
+	}
+	if apps[0].Live.NClients != 5 || len(apps[0].Live.Streams) != 3 {
+		t.Errorf("live has %d clients and %d streams", apps[0].Live.NClients, len(apps[0].Live.Streams))
+	}
+
+	s := apps[0].Live.Streams[0]
+	if s.Name != "studio" || s.Time != 3601234 || s.BytesIn != 2035407600 || s.BWOut != 9046256 || s.BytesOut != 4070815200 {
+		t.Errorf("studio is %+v", s)
+	}
+	if s.Publishing == nil || s.Active == nil {
+		t.Error("studio isn't publishing")
+	}
+	if len(s.Clients) != 3 {
+		t.Fatalf("studio has %d clients", len(s.Clients))
+	}
+	publisher, viewer := s.Clients[0], s.Clients[1]
+	if publisher.Publishing == nil || publisher.Address != "203.0.113.5" || publisher.AVSync != -3 {
+		t.Errorf("Publisher is %+v", publisher)
+	}
+	if viewer.Publishing != nil || viewer.ID != "57" || viewer.Dropped != 14 || viewer.FlashVer != "LNX 9,0,124,2" {
+		t.Errorf("Viewer is %+v", viewer)
+	}
+	if s.Meta.Video.Profile != "High" || s.Meta.Video.Level != "4.0" || s.Meta.Audio.Profile != "LC" {
+		t.Errorf("studio metadata is %+v", s.Meta)
+	}
+
+	if waiting := apps[0].Live.Streams[2]; waiting.Publishing != nil || waiting.Clients[0].Active != nil {
+		t.Errorf("waiting is %+v", waiting)
+	}
+}
+
+func TestPollNodeStats(t *testing.T) {
+	e, cleanup := newTestEnv(t)
+	defer cleanup()
+	srv := statServer()
+	defer srv.Close()
+
+	// Heartbeats decide what's live where, whatever the stat module says
+	e.live.setOnline("studio", "ingest1")
+	e.live.setOnline("elsewhere", "ingest2")
+	e.live.setOnline("waiting", "ingest1")
+	n := node{Name: "ingest1", RTMPURL: "rtmp://ingest1.example.com/live/", StatURL: srv.URL}
+	if err := e.pollNodeStats(n); err != nil {
+		t.Fatal(err)
+	}
+
+	ls, _ := e.live.get("studio")
+	if ls.Stats == nil {
+		t.Fatal("studio has no stats")
+	}
+	want := streamStats{
+		BitrateIn:    4523128,
+		BitrateVideo: 4392056,
+		BitrateAudio: 131072,
+		Clients:      3,
+		VideoCodec:   "H264",
+		Width:        1920,
+		Height:       1080,
+		FrameRate:    25,
+		AudioCodec:   "AAC",
+		AudioRate:    48000,
+		Channels:     2,
+		UpdatedAt:    ls.Stats.UpdatedAt,
+	}
+	if *ls.Stats != want {
+		t.Errorf("studio stats are %+v, want %+v", *ls.Stats, want)
+	}
+
+	for _, name := range []string{
+		"elsewhere", // Published to this node, but heartbeats say it's live on another
+		"waiting",   // Has a viewer, but no publisher
+	} {
+		if ls, _ := e.live.get(name); ls.Stats != nil {
+			t.Errorf("%s has stats %+v", name, *ls.Stats)
+		}
+	}
+	if _, ok := e.live.get("unknown"); ok {
+		t.Error("Stats made a stream live")
+	}
+	if e.live.setStats("studio", &want) {
+		t.Error("Stats of studio changed when polled again")
+	}
+
+	// The node heartbeats say it's live on gets its stats, but not the other
+	// node's stream of the same name
+	n = node{Name: "ingest2", RTMPURL: "rtmp://ingest2.example.com/live", StatURL: srv.URL}
+	if err := e.pollNodeStats(n); err != nil {
+		t.Fatal(err)
+	}
+	if ls, _ := e.live.get("elsewhere"); ls.Stats == nil || ls.Stats.BitrateIn != 2368512 || ls.Stats.Clients != 1 {
+		t.Errorf("elsewhere stats are %+v", ls.Stats)
+	}
+	if ls, _ := e.live.get("studio"); ls.Stats.BitrateIn != want.BitrateIn {
+		t.Errorf("studio stats replaced by another node's: %+v", *ls.Stats)
+	}
+}
+
+func TestFetchStatError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	if _, err := fetchStat(srv.URL); err == nil {
+		t.Error("No error from a stat module returning 404")
+	}
+}
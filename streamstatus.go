@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/ystv/nexus-common"
+)
+
+// statusMessageVersion is the version of the streamstatus protocol. Messages
+// without a version are from agents which predate it, and are read as version 1.
+const statusMessageVersion = 1
+
+const (
+	messageTypeHeartbeat    = "heartbeat"
+	messageTypeStreamUpdate = "stream_update" // Also assumed for messages without a type
+	messageTypeError        = "error"
+
+	eventStreamStatus eventType = "stream_status"
+)
+
+// Codes of the errors sent back to agents
+const (
+	errCodeInvalid     = "invalid_message"
+	errCodeVersion     = "unsupported_version"
+	errCodeStatus      = "unknown_status"
+	errCodeStream      = "unknown_stream"
+	errCodeForbidden   = "forbidden"
+	errCodeServerError = "server_error"
+)
+
+// statusEnvelope is common to every message sent over the streamstatus websocket
+type statusEnvelope struct {
+	Type    string `json:"type"`
+	Version int    `json:"version,omitempty"`
+}
+
+// streamUpdateMessage is sent by an ingest node when a stream starts or stops
+// being published to it
+type streamUpdateMessage struct {
+	statusEnvelope
+	StreamName    string                    `json:"stream_name"`
+	ClientAddress string                    `json:"client_address,omitempty"` // Address of the publisher
+	Status        nexus_common.StreamStatus `json:"status"`                   // ONLINE or TERMINATING
+}
+
+// statusErrorReply is sent back to an agent whose message was rejected
+type statusErrorReply struct {
+	statusEnvelope
+	Code       string `json:"code"`
+	Error      string `json:"error"`
+	StreamName string `json:"stream_name,omitempty"`
+}
+
+// streamStatusEvent is sent to the updates hub when a stream goes live on a
+// node, or stops
+type streamStatusEvent struct {
+	StreamName    string                    `json:"stream_name"`
+	Node          string                    `json:"node"`
+	Status        nexus_common.StreamStatus `json:"status"`
+	ClientAddress string                    `json:"client_address,omitempty"`
+}
+
+// messageError is why a message from an agent was rejected
+type messageError struct {
+	code string
+	err  error
+}
+
+func (m messageError) Error() string {
+	return m.err.Error()
+}
+
+// decodeStrict decodes a message, rejecting unknown fields and trailing data
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return messageError{errCodeInvalid, err}
+	}
+	if dec.More() {
+		return messageError{errCodeInvalid, errors.New("unexpected data after message")}
+	}
+	return nil
+}
+
+// checkVersion rejects messages from a newer version of the protocol
+func (s *statusEnvelope) checkVersion() error {
+	if s.Version < 0 || s.Version > statusMessageVersion {
+		return messageError{errCodeVersion, fmt.Errorf("unsupported version %d, the server speaks version %d", s.Version, statusMessageVersion)}
+	}
+	return nil
+}
+
+// validateStreamUpdate checks an update's fields, and that its stream exists
+func (e *env) validateStreamUpdate(u *streamUpdateMessage) error {
+	if u.StreamName == "" {
+		return messageError{errCodeInvalid, errors.New("stream_name is required")}
+	}
+	if u.Status != nexus_common.StreamStatusOnline && u.Status != nexus_common.StreamStatusTerminating {
+		return messageError{errCodeStatus, fmt.Errorf("unknown status %q", u.Status)}
+	}
+	if u.ClientAddress != "" && net.ParseIP(u.ClientAddress) == nil {
+		return messageError{errCodeInvalid, fmt.Errorf("client_address %q is not an IP address", u.ClientAddress)}
+	}
+	var n int
+	if err := e.db.Get(&n, `SELECT count(*) FROM streams WHERE stream_name = $1`, u.StreamName); err != nil {
+		return messageError{errCodeServerError, err}
+	}
+	if n == 0 {
+		return messageError{errCodeStream, fmt.Errorf("no stream named %s", u.StreamName)}
+	}
+	return nil
+}
+
+// handleStatusMessage handles a message sent by an ingest node over the
+// streamstatus websocket. Heartbeats update the node registry, and stream
+// updates the live registry, which tells clients of the updates hub. Nodes
+// may only report on themselves and the streams they host. Rejected messages
+// get an error reply.
+func (e *env) handleStatusMessage(m *Message) {
+	var envelope statusEnvelope
+	if err := json.Unmarshal(m.data, &envelope); err != nil {
+		e.rejectStatusMessage(m, "", messageError{errCodeInvalid, err})
+		return
+	}
+	if err := envelope.checkVersion(); err != nil {
+		e.rejectStatusMessage(m, "", err)
+		return
+	}
+
+	switch envelope.Type {
+	case messageTypeHeartbeat:
+		var hb heartbeatMessage
+		if err := decodeStrict(m.data, &hb); err != nil {
+			e.rejectStatusMessage(m, "", err)
+			return
+		}
+		if hb.Node != "" && hb.Node != m.node {
+			e.rejectStatusMessage(m, "", messageError{errCodeForbidden, fmt.Errorf("node %s claimed to be %s", m.node, hb.Node)})
+			return
+		}
+		hb.Node = m.node
+		if err := e.handleHeartbeat(m, &hb); err != nil {
+			e.rejectStatusMessage(m, "", messageError{errCodeForbidden, err})
+		}
+
+	case messageTypeStreamUpdate, "":
+		var update streamUpdateMessage
+		if err := decodeStrict(m.data, &update); err != nil {
+			e.rejectStatusMessage(m, "", err)
+			return
+		}
+		if err := e.validateStreamUpdate(&update); err != nil {
+			e.rejectStatusMessage(m, update.StreamName, err)
+			return
+		}
+		if err := e.checkUpdateNode(m.node, &update); err != nil {
+			e.rejectStatusMessage(m, update.StreamName, messageError{errCodeForbidden, err})
+			return
+		}
+		m.log.Infof("Stream %s is %s on %s", update.StreamName, update.Status, m.node)
+
+		switch update.Status {
+		case nexus_common.StreamStatusOnline:
+			e.setStreamOnline(update.StreamName, m.node, update.ClientAddress)
+		case nexus_common.StreamStatusTerminating:
+			e.setStreamOffline(update.StreamName)
+		}
+
+	default:
+		e.rejectStatusMessage(m, "", messageError{errCodeInvalid, fmt.Errorf("unknown message type %q", envelope.Type)})
+	}
+}
+
+// rejectStatusMessage logs why a message was rejected, and tells the agent
+func (e *env) rejectStatusMessage(m *Message, streamName string, err error) {
+	code := errCodeInvalid
+	if merr, ok := err.(messageError); ok {
+		code = merr.code
+	}
+	if code == errCodeServerError {
+		m.log.Errorf("Error handling message from %s: %s", m.remoteAddr, err.Error())
+		err = errors.New("internal server error")
+	} else {
+		m.log.Warnf("Rejected message from %s: %s", m.remoteAddr, err.Error())
+	}
+
+	b, merr := json.Marshal(&statusErrorReply{
+		statusEnvelope: statusEnvelope{messageTypeError, statusMessageVersion},
+		Code:           code,
+		Error:          err.Error(),
+		StreamName:     streamName,
+	})
+	if merr != nil {
+		m.log.Errorf("Error encoding error reply: %s", merr.Error())
+		return
+	}
+	m.reply(b)
+}
+
+// checkUpdateNode checks a node may report on a stream. A stream live on one
+// node can't be reported by another, and only a stream going live may be
+// reported by a node which doesn't yet host it.
+func (e *env) checkUpdateNode(node string, update *streamUpdateMessage) error {
+	if live, ok := e.live.get(update.StreamName); ok {
+		if live.Node != node {
+			return fmt.Errorf("node %s reported stream %s, which is live on %s", node, update.StreamName, live.Node)
+		}
+		return nil
+	}
+	if update.Status != nexus_common.StreamStatusOnline {
+		return fmt.Errorf("node %s reported stream %s, which isn't live", node, update.StreamName)
+	}
+	return nil
+}
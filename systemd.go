@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The first file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+// activatedListeners returns the sockets systemd passed to the server, keyed
+// by their FileDescriptorName. The environment variables describing them are
+// cleared, so child processes don't try to use them too.
+func activatedListeners() (map[string]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make(map[string]net.Listener)
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return listeners, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		name := "unknown" // What systemd calls sockets without a FileDescriptorName
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener dups the descriptor
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := listeners[name]; ok {
+			return nil, errors.New("More than one socket named " + name)
+		}
+		listeners[name] = ln
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state change such as READY=1 to systemd. It does nothing
+// if the server wasn't started by systemd with a notify socket.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:] // Abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Warnf("Unable to notify systemd of %s: %s", state, err.Error())
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Warnf("Unable to notify systemd of %s: %s", state, err.Error())
+	}
+}
+
+// watchdogInterval returns how often systemd expects to hear the server is
+// alive, or zero if the watchdog isn't enabled
+func watchdogInterval() time.Duration {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// keepAlive pets the systemd watchdog at half its interval, for as long as the
+// database responds, until stop is closed
+func (e *env) keepAlive(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := e.db.Ping(); err != nil {
+			log.Errorf("Database not responding, not notifying watchdog: %s", err.Error())
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
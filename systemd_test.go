@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// notifySocket binds a socket for sdNotify to send to, as systemd would, and
+// points NOTIFY_SOCKET at it. The returned function removes it again.
+func notifySocket(t *testing.T) (*net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "nexus-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	os.Setenv("NOTIFY_SOCKET", path)
+	return conn, func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// readNotify returns the next state sent to the notify socket
+func readNotify(t *testing.T, conn *net.UnixConn, timeout time.Duration) string {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Nothing sent to the notify socket: %s", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	conn, cleanup := notifySocket(t)
+	defer cleanup()
+
+	for _, state := range []string{"READY=1", "STOPPING=1"} {
+		sdNotify(state)
+		if got := readNotify(t, conn, time.Second); got != state {
+			t.Errorf("Sent %q, want %q", got, state)
+		}
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	tests := []struct {
+		usec, pid string
+		interval  time.Duration
+	}{
+		{"", "", 0},
+		{"0", "", 0},
+		{"nonsense", "", 0},
+		{"30000000", "", 30 * time.Second},
+		{"30000000", strconv.Itoa(os.Getpid()), 30 * time.Second},
+		{"30000000", strconv.Itoa(os.Getpid() + 1), 0}, // Meant for another process
+	}
+	for _, tt := range tests {
+		os.Setenv("WATCHDOG_USEC", tt.usec)
+		os.Setenv("WATCHDOG_PID", tt.pid)
+		if got := watchdogInterval(); got != tt.interval {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: interval %s, want %s", tt.usec, tt.pid, got, tt.interval)
+		}
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	conn, cleanup := notifySocket(t)
+	defer cleanup()
+	os.Setenv("WATCHDOG_USEC", "200000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	db, err := sqlx.Connect("ql", "memory://keepalive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &env{db: db}
+
+	interval := watchdogInterval()
+	if interval != 200*time.Millisecond {
+		t.Fatalf("Watchdog interval is %s, want 200ms", interval)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go e.keepAlive(interval, stop)
+
+	last := time.Now()
+	for i := 0; i < 3; i++ {
+		if got := readNotify(t, conn, interval); got != "WATCHDOG=1" {
+			t.Fatalf("Sent %q, want WATCHDOG=1", got)
+		}
+		now := time.Now()
+		// The watchdog is petted at half its interval
+		if gap := now.Sub(last); gap < interval/4 || gap > interval*3/4 {
+			t.Errorf("WATCHDOG=1 sent %s after the last, want about %s", gap, interval/2)
+		}
+		last = now
+	}
+}